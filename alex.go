@@ -6,6 +6,29 @@ var (
 	ErrEmptyKey            = errors.New("empty key")
 	ErrInsufficientEntropy = errors.New("insufficient random entropy")
 	ErrFailedToDecrypt     = errors.New("failed to decrypt")
+	ErrUnsupportedVersion  = errors.New("unsupported format version")
+	ErrUnsupportedSuite    = errors.New("unsupported cipher suite")
+	ErrUnsupportedFlags    = errors.New("unsupported header flags")
+	ErrMessageTooLarge     = errors.New("message too large")
+	ErrTruncated           = errors.New("truncated message")
+	ErrMalformedHeader     = errors.New("malformed header")
+	ErrTooManyRecipients   = errors.New("too many recipients")
+	ErrNotSigned           = errors.New("message is not signed")
+	ErrUnexpectedSigner    = errors.New("message is signed by an unexpected key")
+	ErrBadSignature        = errors.New("invalid signature")
+	ErrAnonymousSender     = errors.New("anonymous sender can not be authenticated")
+	ErrNotAuthenticated    = errors.New("sender is not authenticated")
+	ErrUnexpectedSender    = errors.New("message is from an unexpected sender")
+	ErrBadAuthenticator    = errors.New("invalid sender authenticator")
+	ErrSlotSize            = errors.New("recipient slot is too large")
+	ErrMissingFinalChunk   = errors.New("missing final chunk")
+	ErrChunkOutOfOrder     = errors.New("chunk out of order")
+	ErrTrailingData        = errors.New("unexpected data after final chunk")
+	ErrBadPadding          = errors.New("invalid padding")
+	ErrMetadataTooLarge    = errors.New("metadata too large")
+	ErrMalformedMetadata   = errors.New("malformed metadata")
+	ErrNotArchive          = errors.New("message is not an archive")
+	ErrMalformedArchive    = errors.New("malformed archive")
 )
 
 const (
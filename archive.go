@@ -0,0 +1,254 @@
+package alex
+
+import (
+	"archive/tar"
+	"bytes"
+	"encoding/binary"
+	"encoding/json"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// An archive envelope sets flagArchive, its message is a tar stream whose
+// last entry is the index of the others, named archiveIndexName. The
+// index is a JSON array of ArchiveEntry, padded with spaces and followed
+// by the length of the entry as 8 big-endian bytes, so the entry fills
+// whole tar blocks and ends right before the two zero blocks which end the
+// stream. It can be found from the end of the message without reading the
+// entries before it.
+//
+// The message is a plain tar stream, Decrypt returns it as is.
+const (
+	archiveIndexName = ".alex-index"
+	tarBlockSize     = 512
+	tarTrailerLen    = 2 * tarBlockSize
+)
+
+// ArchiveEntry is an entry of the index of an archive.
+type ArchiveEntry struct {
+	Name    string
+	Type    byte // tar.TypeReg, tar.TypeDir, ...
+	Mode    int64
+	ModTime time.Time
+	Size    int64
+
+	// Offset is where the content of the entry starts in the tar stream.
+	Offset int64
+}
+
+// ArchiveWriter writes files as an encrypted tar stream, as a tar.Writer
+// would, and an index of them when it is closed.
+type ArchiveWriter struct {
+	w     EncryptWriter
+	count countingWriter
+	tw    *tar.Writer
+	index []ArchiveEntry
+}
+
+type countingWriter struct {
+	w io.Writer
+	n int64
+}
+
+func (c *countingWriter) Write(p []byte) (int, error) {
+	n, err := c.w.Write(p)
+	c.n += int64(n)
+	return n, err
+}
+
+// NewArchiveWriter returns an ArchiveWriter which encrypts the archive for
+// each of the peers, as NewEncryptWriterWithOptions does. Only archives
+// which are not compressed can be read out of order.
+func NewArchiveWriter(w io.Writer, privateKey *PrivateKey, opts *EncryptOptions, peerPublicKeys ...*PublicKey) (*ArchiveWriter, error) {
+	ew, err := newEncryptWriter(w, privateKey, opts, flagArchive, peerPublicKeys...)
+	if err != nil {
+		return nil, err
+	}
+	a := &ArchiveWriter{w: ew, count: countingWriter{w: ew}}
+	a.tw = tar.NewWriter(&a.count)
+	return a, nil
+}
+
+// WriteHeader starts a new entry, its content is written with Write.
+func (a *ArchiveWriter) WriteHeader(hdr *tar.Header) error {
+	if err := a.tw.WriteHeader(hdr); err != nil {
+		return err
+	}
+	a.index = append(a.index, ArchiveEntry{
+		Name:    hdr.Name,
+		Type:    hdr.Typeflag,
+		Mode:    hdr.Mode,
+		ModTime: hdr.ModTime,
+		Size:    hdr.Size,
+		Offset:  a.count.n,
+	})
+	return nil
+}
+
+// Write writes the content of the current entry.
+func (a *ArchiveWriter) Write(p []byte) (int, error) {
+	return a.tw.Write(p)
+}
+
+// AddDir adds the files under the directory root, named by their path
+// relative to it.
+func (a *ArchiveWriter) AddDir(root string) error {
+	return filepath.Walk(root, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		name, err := filepath.Rel(root, path)
+		if err != nil || name == "." {
+			return err
+		}
+		var link string
+		if info.Mode()&os.ModeSymlink != 0 {
+			if link, err = os.Readlink(path); err != nil {
+				return err
+			}
+		}
+		hdr, err := tar.FileInfoHeader(info, link)
+		if err != nil {
+			return err
+		}
+		hdr.Name = filepath.ToSlash(name)
+		if info.IsDir() {
+			hdr.Name += "/"
+		}
+		if err := a.WriteHeader(hdr); err != nil {
+			return err
+		}
+		if !info.Mode().IsRegular() {
+			return nil
+		}
+		f, err := os.Open(path)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		_, err = io.Copy(a.tw, f)
+		return err
+	})
+}
+
+// Abort stops the archive without its index and final chunk, as
+// EncryptWriter.Abort does.
+func (a *ArchiveWriter) Abort() error {
+	return a.w.Abort()
+}
+
+// Close writes the index and the end of the tar stream, and closes the
+// envelope. It does not close the underlying writer.
+func (a *ArchiveWriter) Close() error {
+	if err := a.writeIndex(); err != nil {
+		a.w.Abort()
+		return err
+	}
+	return a.w.Close()
+}
+
+// writeIndex writes the index and the end of the tar stream.
+func (a *ArchiveWriter) writeIndex() error {
+	index, err := json.Marshal(a.index)
+	if err != nil {
+		return err
+	}
+	size := (int64(len(index)) + 8 + tarBlockSize - 1) &^ (tarBlockSize - 1)
+	index = append(index, bytes.Repeat([]byte{' '}, int(size)-len(index))...)
+	binary.BigEndian.PutUint64(index[size-8:], uint64(size))
+
+	hdr := &tar.Header{
+		Name:     archiveIndexName,
+		Typeflag: tar.TypeReg,
+		Mode:     0600,
+		Size:     size,
+	}
+	if err := a.tw.WriteHeader(hdr); err != nil {
+		return err
+	}
+	if _, err := a.tw.Write(index); err != nil {
+		return err
+	}
+	return a.tw.Close()
+}
+
+// ArchiveReader reads the entries of an archive envelope in order, as a
+// tar.Reader would, without its index.
+type ArchiveReader struct {
+	tr *tar.Reader
+	r  io.ReadCloser // of the message
+}
+
+// NewArchiveReader returns a reader of the archive in the envelope read
+// from r, it fails with ErrNotArchive if the envelope is not an archive.
+func NewArchiveReader(r io.Reader, privateKey *PrivateKey, opts *DecryptOptions) (*ArchiveReader, error) {
+	content, d, err := newReader(r, privateKey, opts)
+	if err != nil {
+		return nil, err
+	}
+	if d == nil || !d.archive {
+		content.Close()
+		return nil, ErrNotArchive
+	}
+	return &ArchiveReader{tar.NewReader(content), content}, nil
+}
+
+// Next advances to the next entry, it returns io.EOF at the end of the
+// archive. The rest of the message is read first, so the signer or sender
+// of the envelope is verified by then.
+func (a *ArchiveReader) Next() (*tar.Header, error) {
+	hdr, err := a.tr.Next()
+	if err == nil && hdr.Name == archiveIndexName {
+		hdr, err = a.tr.Next()
+		if err == nil {
+			// the index has to be the last entry
+			return nil, ErrMalformedArchive
+		}
+	}
+	if err == io.EOF {
+		if _, err := io.Copy(ioutil.Discard, a.r); err != nil {
+			return nil, err
+		}
+	}
+	return hdr, err
+}
+
+// Read reads the content of the current entry.
+func (a *ArchiveReader) Read(p []byte) (int, error) {
+	return a.tr.Read(p)
+}
+
+// Close releases a reader which is not read to the end, as the reader of
+// NewDecryptReader does.
+func (a *ArchiveReader) Close() error {
+	return a.r.Close()
+}
+
+// ReadArchiveIndex reads the index from the end of the tar stream of an
+// archive, of size bytes.
+func ReadArchiveIndex(ra io.ReaderAt, size int64) ([]ArchiveEntry, error) {
+	var l [8]byte
+	end := size - tarTrailerLen
+	if end < int64(len(l)) {
+		return nil, ErrMalformedArchive
+	}
+	if _, err := ra.ReadAt(l[:], end-int64(len(l))); err != nil {
+		return nil, err
+	}
+	indexLen := int64(binary.BigEndian.Uint64(l[:]))
+	if indexLen < int64(len(l)) || indexLen > end || indexLen%tarBlockSize != 0 {
+		return nil, ErrMalformedArchive
+	}
+	index := make([]byte, indexLen-int64(len(l)))
+	if _, err := ra.ReadAt(index, end-indexLen); err != nil {
+		return nil, err
+	}
+	var entries []ArchiveEntry
+	if err := json.Unmarshal(index, &entries); err != nil {
+		return nil, ErrMalformedArchive
+	}
+	return entries, nil
+}
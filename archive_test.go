@@ -0,0 +1,138 @@
+package alex
+
+import (
+	"archive/tar"
+	"bytes"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestArchive(t *testing.T) {
+	sender, _ := generateKeys(t)
+	recipient, recipientPublicKey := generateKeys(t)
+
+	root := t.TempDir()
+	files := map[string]string{
+		"app.conf":        "listen = :8080\n",
+		"conf.d/tls.conf": string(bytes.Repeat([]byte("cert = /etc/tls\n"), 5000)),
+		"conf.d/empty":    "",
+	}
+	for name, content := range files {
+		path := filepath.Join(root, filepath.FromSlash(name))
+		if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := ioutil.WriteFile(path, []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	var enc bytes.Buffer
+	a, err := NewArchiveWriter(&enc, sender, &EncryptOptions{Pad: true}, recipientPublicKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := a.AddDir(root); err != nil {
+		t.Fatal(err)
+	}
+	if err := a.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	h, err := ParseHeader(bytes.NewReader(enc.Bytes()))
+	if err != nil || !h.Archive {
+		t.Errorf("Expected an archive header but got %+v, %v", h, err)
+	}
+
+	ar, err := NewArchiveReader(bytes.NewReader(enc.Bytes()), recipient, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	read := map[string]string{}
+	for {
+		hdr, err := ar.Next()
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			t.Fatal(err)
+		}
+		content, err := ioutil.ReadAll(ar)
+		if err != nil {
+			t.Fatal(err)
+		}
+		read[hdr.Name] = string(content)
+	}
+	if len(read) != len(files)+1 || read["conf.d/"] != "" {
+		t.Errorf("Expected the files and their directory but got %d entries", len(read))
+	}
+	for name, content := range files {
+		if read[name] != content {
+			t.Errorf("%s: Expected %d bytes but got %d", name, len(content), len(read[name]))
+		}
+	}
+
+	// the index is found from the end of the tar stream
+	plain, err := Decrypt(enc.Bytes(), recipient)
+	if err != nil {
+		t.Fatalf("Unexpected decrypt error: %s", err)
+	}
+	index, err := ReadArchiveIndex(bytes.NewReader(plain), int64(len(plain)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(index) != len(files)+1 {
+		t.Errorf("Expected %d entries in the index but got %d", len(files)+1, len(index))
+	}
+	for _, entry := range index {
+		content := string(plain[entry.Offset : entry.Offset+entry.Size])
+		if content != read[entry.Name] {
+			t.Errorf("%s: Index points to the wrong content", entry.Name)
+		}
+	}
+
+	msg, err := Encrypt([]byte("Hello World"), sender, recipientPublicKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := NewArchiveReader(bytes.NewReader(msg), recipient, nil); err != ErrNotArchive {
+		t.Errorf("Expected %s but got %v", ErrNotArchive, err)
+	}
+	if _, err := ReadArchiveIndex(bytes.NewReader(plain[:len(plain)-1]), int64(len(plain)-1)); err != ErrMalformedArchive {
+		t.Errorf("Expected %s but got %v", ErrMalformedArchive, err)
+	}
+
+	// the signature is verified before the end of the archive, even with
+	// chunks of padding after it
+	signingKey, _ := GenerateSigningKey(testRand(0x21))
+	var signed bytes.Buffer
+	a, err = NewArchiveWriter(&signed, sender, &EncryptOptions{Pad: true, SigningKey: &signingKey}, recipientPublicKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// just over 2 MiB, which Padmé pads into one more chunk
+	big := make([]byte, 2<<20)
+	if err := a.WriteHeader(&tar.Header{Name: "big", Typeflag: tar.TypeReg, Mode: 0600, Size: int64(len(big))}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := a.Write(big); err != nil {
+		t.Fatal(err)
+	}
+	if err := a.Close(); err != nil {
+		t.Fatal(err)
+	}
+	forged := signed.Bytes()
+	forged[len(forged)-1] ^= 1
+	ar, err = NewArchiveReader(bytes.NewReader(forged), recipient, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for err == nil {
+		_, err = ar.Next()
+	}
+	if err != ErrBadSignature {
+		t.Errorf("Expected %s but got %v", ErrBadSignature, err)
+	}
+}
@@ -0,0 +1,29 @@
+package alex
+
+import (
+	"crypto/subtle"
+
+	"desource.net/alex/pkg/blake2b"
+)
+
+// An authenticated envelope sets flagAuthenticated, and after the payload
+// it carries a tag for each recipient slot, in the same order. The tag is a
+// MAC of the transcript keyed by the static key shared by the sender and
+// that recipient. Either of them could have computed it, so the tag proves
+// the sender to the recipient but can't prove anything to anyone else.
+const authTagLen = 32
+
+// authTag returns the tag of the transcript digest for a shared key.
+func authTag(shared *sharedKey, digest []byte) []byte {
+	h, _ := blake2b.New(&blake2b.Config{
+		Size:   authTagLen,
+		Key:    shared[:],
+		Person: []byte("alex-auth"),
+	})
+	h.Write(digest)
+	return h.Sum(nil)
+}
+
+func verifyAuthTag(shared *sharedKey, digest, tag []byte) bool {
+	return subtle.ConstantTimeCompare(authTag(shared, digest), tag) == 1
+}
@@ -0,0 +1,101 @@
+package alex
+
+import (
+	"bytes"
+	"crypto/rand"
+	"testing"
+)
+
+func TestEncryptAuthenticated(t *testing.T) {
+	sender, senderPublicKey := generateKeys(t)
+	recipient1, recipientPublicKey1 := generateKeys(t)
+	recipient2, recipientPublicKey2 := generateKeys(t)
+	signingKey, _ := GenerateSigningKey(rand.Reader)
+
+	for _, opts := range []*EncryptOptions{
+		{Authenticate: true},
+		{Authenticate: true, SigningKey: &signingKey},
+	} {
+		msg := make([]byte, chunkSize+1)
+		enc, err := EncryptWithOptions(msg, sender, opts, recipientPublicKey1, recipientPublicKey2)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		for _, recipient := range []*PrivateKey{recipient1, recipient2} {
+			dec, from, err := DecryptAuthenticated(enc, recipient)
+			if err != nil {
+				t.Fatalf("Unexpected decrypt error: %s", err)
+			}
+			if !bytes.Equal(dec, msg) {
+				t.Error("Decrypted message not equal")
+			}
+			if *from != *senderPublicKey {
+				t.Errorf("Expected sender %s but got %s", senderPublicKey, from)
+			}
+		}
+	}
+}
+
+func TestDecryptAuthenticatedErrors(t *testing.T) {
+	sender, senderPublicKey := generateKeys(t)
+	recipient1, recipientPublicKey1 := generateKeys(t)
+	recipient2, recipientPublicKey2 := generateKeys(t)
+	_, otherPublicKey := generateKeys(t)
+
+	msg := []byte("Hello World")
+	if _, err := EncryptWithOptions(msg, nil, &EncryptOptions{Authenticate: true}, recipientPublicKey1); err != ErrAnonymousSender {
+		t.Errorf("Expected %s but got %v", ErrAnonymousSender, err)
+	}
+
+	plain, err := Encrypt(msg, sender, recipientPublicKey1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	enc, err := EncryptWithOptions(msg, sender, &EncryptOptions{Authenticate: true}, recipientPublicKey1, recipientPublicKey2)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// the second recipient knows the session key and can seal another
+	// payload, but can't make the tag for the first recipient
+	h, err := readHeader(bytes.NewReader(enc))
+	if err != nil {
+		t.Fatal(err)
+	}
+	shared := recipient2.sharedKey(&h.sender)
+	sessionKey, _, _ := h.unwrap(&x25519Identity{shared})
+	aead, _ := newAEAD(h.suite, sessionKey)
+	nonce := make([]byte, aead.NonceSize())
+	chunkNonce(nonce, h.nonce, 0, nonceFinalChunk)
+	forged := append([]byte(nil), h.raw...)
+	forged = append(forged, 0x80, 0, 0, 0)
+	forged = aead.Seal(forged, nonce, []byte("Hello Moon!"), nil)
+	transcript := newTranscript()
+	transcript.Write(forged)
+	forged = append(forged, make([]byte, authTagLen)...)
+	forged = append(forged, authTag(&shared, transcript.Sum(nil))...)
+
+	if _, _, err := DecryptAuthenticated(forged, recipient2); err != nil {
+		t.Errorf("Expected forger to accept their own tag, got %v", err)
+	}
+
+	for _, tc := range []struct {
+		name string
+		data []byte
+		opts *DecryptOptions
+		err  error
+	}{
+		{"not authenticated", plain, &DecryptOptions{Sender: senderPublicKey}, ErrNotAuthenticated},
+		{"other sender", enc, &DecryptOptions{Sender: otherPublicKey}, ErrUnexpectedSender},
+		{"forged", forged, &DecryptOptions{Sender: senderPublicKey}, ErrBadAuthenticator},
+	} {
+		if _, err := DecryptWithOptions(tc.data, recipient1, tc.opts); err != tc.err {
+			t.Errorf("%s: Expected %s but got %v", tc.name, tc.err, err)
+		}
+	}
+
+	if _, _, err := DecryptAuthenticated(plain, recipient1); err != ErrNotAuthenticated {
+		t.Errorf("Expected %s but got %v", ErrNotAuthenticated, err)
+	}
+}
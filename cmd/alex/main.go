@@ -1,14 +1,18 @@
 package main // import "desource.net/alex/cmd/alex"
 
 import (
+	"archive/tar"
+	"bytes"
 	"crypto/rand"
 	"errors"
 	"flag"
 	"fmt"
 	"io"
 	"io/ioutil"
+	"mime"
 	"os"
 	"path/filepath"
+	"strings"
 
 	"desource.net/alex"
 )
@@ -17,16 +21,36 @@ const version = "0.1-dev"
 
 var (
 	ErrMissingPrivateKey = errors.New("missing --private-key")
+	ErrUnknownCipher     = errors.New("unknown --cipher, expected aes or chacha")
+	ErrNoMetadata        = errors.New("message has no metadata to --restore")
+	ErrBadFileName       = errors.New("message metadata has an invalid file name")
+	ErrNotInArchive      = errors.New("file not found in archive")
 )
 
 var (
-	privateKey string
-	peerKeys   recipientKeys
+	privateKey  string
+	peerKeys    recipientKeys
+	removeKeys  recipientKeys
+	signingKey  string
+	signerKey   string
+	senderKey   string
+	authMode    bool
+	padMode     bool
+	padLength   bool
+	compress    bool
+	metadata    *alex.Metadata
+	restore     bool
+	archiveDir  string
+	listMode    bool
+	extractPath string
+	jobs        int
+	cipherName  string
+	context     string
+	hexMode     bool
 
 	debugMode bool
 )
 
-// TODO: Add support for recrypt-ing
 func main() {
 	proc := filepath.Base(os.Args[0])
 	var err error
@@ -58,6 +82,12 @@ func main() {
 	case "pubkey":
 		err = PubKey(os.Stdin, os.Stdout)
 
+	case "signkey":
+		err = GenSigningKey(os.Stdout)
+
+	case "verifykey":
+		err = VerifyKey(os.Stdin, os.Stdout)
+
 	case "enc", "encrypt":
 		flags := flag.NewFlagSet("encrypt", flag.ContinueOnError)
 		flags.Usage = func() {}
@@ -66,6 +96,16 @@ func main() {
 		flags.StringVar(&privateKey, "private-key", "", "")
 		flags.Var(&peerKeys, "r", "")
 		flags.Var(&peerKeys, "recipient", "")
+		flags.StringVar(&signingKey, "s", "", "")
+		flags.StringVar(&signingKey, "sign", "", "")
+		flags.BoolVar(&authMode, "auth", false, "")
+		flags.BoolVar(&padMode, "pad-recipients", false, "")
+		flags.BoolVar(&padLength, "pad", false, "")
+		flags.BoolVar(&compress, "compress", false, "")
+		flags.StringVar(&archiveDir, "archive", "", "")
+		flags.IntVar(&jobs, "jobs", 1, "")
+		flags.StringVar(&cipherName, "cipher", "aes", "")
+		flags.StringVar(&context, "context", "", "")
 		// flags.BoolVar(&ammor, "a", false, "")
 		// flags.BoolVar(&ammor, "ammor", false, "")
 
@@ -73,7 +113,18 @@ func main() {
 			fmt.Fprintf(os.Stderr, "%s %s: %s\n", proc, cmd, err)
 			os.Exit(2)
 		}
-		err = Encrypt(os.Stdin, os.Stdout)
+		in := os.Stdin
+		if flags.NArg() > 0 {
+			// keep the name, mode and mtime of the file
+			if in, err = os.Open(flags.Arg(0)); err != nil {
+				break
+			}
+			defer in.Close()
+			if metadata, err = FileMetadata(in); err != nil {
+				break
+			}
+		}
+		err = Encrypt(in, os.Stdout)
 
 		// TODO encrypt specific help
 
@@ -83,6 +134,13 @@ func main() {
 
 		flags.StringVar(&privateKey, "k", "", "")
 		flags.StringVar(&privateKey, "key", "", "")
+		flags.StringVar(&signerKey, "signer", "", "")
+		flags.StringVar(&senderKey, "from", "", "")
+		flags.StringVar(&context, "context", "", "")
+		flags.BoolVar(&restore, "restore", false, "")
+		flags.BoolVar(&listMode, "list", false, "")
+		flags.StringVar(&extractPath, "extract", "", "")
+		flags.IntVar(&jobs, "jobs", 1, "")
 
 		if err := flags.Parse(args); err != nil {
 			fmt.Fprintf(os.Stderr, "%s %s: %s\n", proc, cmd, err)
@@ -90,6 +148,35 @@ func main() {
 		}
 		err = Decrypt(os.Stdin, os.Stdout)
 
+	case "recrypt":
+		flags := flag.NewFlagSet("recrypt", flag.ContinueOnError)
+		flags.Usage = func() {}
+
+		flags.StringVar(&privateKey, "key", "", "")
+		flags.StringVar(&privateKey, "private-key", "", "")
+		flags.Var(&peerKeys, "r", "")
+		flags.Var(&peerKeys, "recipient", "")
+		flags.Var(&removeKeys, "remove", "")
+
+		if err := flags.Parse(args); err != nil {
+			fmt.Fprintf(os.Stderr, "%s %s: %s\n", proc, cmd, err)
+			os.Exit(2)
+		}
+		err = Recrypt(os.Stdin, os.Stdout)
+
+	case "inspect":
+		flags := flag.NewFlagSet("inspect", flag.ContinueOnError)
+		flags.Usage = func() {}
+
+		flags.BoolVar(&hexMode, "x", false, "")
+		flags.BoolVar(&hexMode, "hex", false, "")
+
+		if err := flags.Parse(args); err != nil {
+			fmt.Fprintf(os.Stderr, "%s %s: %s\n", proc, cmd, err)
+			os.Exit(2)
+		}
+		err = Inspect(os.Stdin, os.Stdout)
+
 	case "v", "version", "-v", "--version":
 		Version(os.Stdout)
 
@@ -133,6 +220,33 @@ func PubKey(in io.Reader, out io.Writer) error {
 	return nil
 }
 
+func GenSigningKey(out io.Writer) error {
+	key, err := alex.GenerateSigningKey(rand.Reader)
+	if err != nil {
+		return err
+	}
+	fmt.Fprintln(out, key.String())
+	return nil
+}
+
+func VerifyKey(in io.Reader, out io.Writer) error {
+	var key string
+	_, err := fmt.Fscanln(in, &key)
+	if err != nil {
+		// TODO improve errors?
+		return err
+	}
+
+	signing, err := alex.DecodeSigningKey(key)
+	if err != nil {
+		return err
+	}
+
+	verify := signing.VerifyKey()
+	fmt.Fprintln(out, verify.String())
+	return nil
+}
+
 type recipientKeys []string
 
 func (keys *recipientKeys) String() string {
@@ -156,52 +270,333 @@ func (keys *recipientKeys) DecodeKeys() (publicKeys []*alex.PublicKey, err error
 }
 
 func Encrypt(in io.Reader, out io.Writer) error {
-	if privateKey == "" {
-		return ErrMissingPrivateKey
-	}
-	key, err := alex.DecodePrivateKey(privateKey)
-	if err != nil {
-		return err
-	}
 	peers, err := peerKeys.DecodeKeys()
 	if err != nil {
 		return err
 	}
+
+	// without a private key the message is sent anonymously
+	var key *alex.PrivateKey
+	if privateKey != "" {
+		k, err := alex.DecodePrivateKey(privateKey)
+		if err != nil {
+			return err
+		}
+		key = &k
+	} else if len(peers) == 0 {
+		return ErrMissingPrivateKey
+	}
+
 	if len(peers) == 0 {
 		warn("no recpient specified, defaulting to private key")
 		pubKey := key.PublicKey()
 		peers = append(peers, &pubKey)
 	}
 
+	opts := alex.EncryptOptions{
+		Authenticate:  authMode,
+		PadRecipients: padMode,
+		Pad:           padLength,
+		Compress:      compress,
+		Metadata:      metadata,
+		Jobs:          jobs,
+		AD:            []byte(context),
+	}
+	switch cipherName {
+	case "", "aes":
+		opts.Suite = alex.SuiteAES256GCM
+	case "chacha":
+		opts.Suite = alex.SuiteXChaCha20Poly1305
+	default:
+		return ErrUnknownCipher
+	}
+	if signingKey != "" {
+		k, err := alex.DecodeSigningKey(signingKey)
+		if err != nil {
+			return err
+		}
+		opts.SigningKey = &k
+	}
+
 	if debugMode {
-		debug("Private key %s", key)
+		if key != nil {
+			debug("Private key %s", key)
+		} else {
+			debug("Anonymous sender")
+		}
 		debug("Public keys")
 		for i, p := range peers {
 			debug("%3d] %s", i+1, p)
 		}
+		if opts.SigningKey != nil {
+			debug("Verify key %s", opts.SigningKey.VerifyKey())
+		}
 	}
 
-	message, err := ioutil.ReadAll(in)
+	if archiveDir != "" {
+		return EncryptArchive(out, key, &opts, peers)
+	}
+
+	enc, err := alex.NewEncryptWriterWithOptions(out, key, &opts, peers...)
 	if err != nil {
+		// TODO: improve error
+		return err
+	}
+	if _, err := io.Copy(enc, in); err != nil {
 		// TODO improve error
+		enc.Abort()
 		return err
 	}
+	return enc.Close()
+}
 
-	enc, err := alex.Encrypt(message, &key, peers...)
+func Decrypt(in io.Reader, out io.Writer) error {
+	if privateKey == "" {
+		return ErrMissingPrivateKey
+	}
+	key, err := alex.DecodePrivateKey(privateKey)
 	if err != nil {
-		// TODO: improve error
 		return err
 	}
-	_, err = out.Write(enc)
+	debug("Private key: %s", key)
+
+	opts := alex.DecryptOptions{AD: []byte(context), Jobs: jobs}
+	if signerKey != "" {
+		k, err := alex.DecodeVerifyKey(signerKey)
+		if err != nil {
+			return err
+		}
+		debug("Signer: %s", k)
+		opts.Signer = &k
+	}
+	if senderKey != "" {
+		k, err := alex.DecodePublicKey(senderKey)
+		if err != nil {
+			return err
+		}
+		debug("Sender: %s", k)
+		opts.Sender = &k
+	}
+
+	if listMode || extractPath != "" {
+		return DecryptArchive(in, out, &key, &opts)
+	}
+
+	dec, md, err := alex.NewDecryptReaderWithMetadata(in, &key, &opts)
 	if err != nil {
 		// TODO: improve error
 		return err
 	}
+	defer dec.Close()
+	if restore {
+		return Restore(dec, md)
+	}
+	if opts.Signer != nil || opts.Sender != nil {
+		// the signer and sender are verified at the end of the message,
+		// nothing is written before then
+		held, err := holdFile()
+		if err != nil {
+			return err
+		}
+		defer dropFile(held)
+		if _, err := io.Copy(held, dec); err != nil {
+			return err
+		}
+		return releaseFile(out, held)
+	}
+	if _, err := io.Copy(out, dec); err != nil {
+		// TODO: improve error
+		return err
+	}
 
 	return nil
 }
 
-func Decrypt(in io.Reader, out io.Writer) error {
+// holdFile returns a temporary file which holds the output of a message
+// until it is verified.
+func holdFile() (*os.File, error) {
+	return ioutil.TempFile("", "alex-")
+}
+
+// releaseFile writes what was written to the held file to out.
+func releaseFile(out io.Writer, f *os.File) error {
+	if _, err := f.Seek(0, io.SeekStart); err != nil {
+		return err
+	}
+	_, err := io.Copy(out, f)
+	return err
+}
+
+// dropFile closes and removes a held file.
+func dropFile(f *os.File) {
+	f.Close()
+	os.Remove(f.Name())
+}
+
+// EncryptArchive encrypts the files under archiveDir as an archive.
+func EncryptArchive(out io.Writer, key *alex.PrivateKey, opts *alex.EncryptOptions, peers []*alex.PublicKey) error {
+	enc, err := alex.NewArchiveWriter(out, key, opts, peers...)
+	if err != nil {
+		return err
+	}
+	if err := enc.AddDir(archiveDir); err != nil {
+		enc.Abort()
+		return err
+	}
+	return enc.Close()
+}
+
+// DecryptArchive lists the entries of an archive, or writes the content of
+// the one at extractPath to out.
+func DecryptArchive(in io.Reader, out io.Writer, key *alex.PrivateKey, opts *alex.DecryptOptions) error {
+	// a file is read by its index, other input in order
+	if f, ok := in.(*os.File); ok {
+		if info, err := f.Stat(); err == nil && info.Mode().IsRegular() {
+			offset, err := f.Seek(0, io.SeekCurrent)
+			if err != nil {
+				return err
+			}
+			err = DecryptArchiveAt(io.NewSectionReader(f, offset, info.Size()-offset), out, key, opts)
+			if err != alex.ErrUnsupportedFlags {
+				return err
+			}
+			debug("Reading the archive in order")
+		}
+	}
+
+	dec, err := alex.NewArchiveReader(in, key, opts)
+	if err != nil {
+		return err
+	}
+	defer dec.Close()
+
+	// the signer and sender are verified at the end of the archive,
+	// nothing is written before then
+	verify := opts.Signer != nil || opts.Sender != nil
+	w := out
+	if verify {
+		held, err := holdFile()
+		if err != nil {
+			return err
+		}
+		defer dropFile(held)
+		w = held
+	}
+	found := false
+	for {
+		hdr, err := dec.Next()
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			return err
+		}
+		if listMode {
+			fmt.Fprintln(w, hdr.Name)
+			continue
+		}
+		if !found && hdr.Name == extractPath && hdr.Typeflag == tar.TypeReg {
+			if _, err := io.Copy(w, dec); err != nil || !verify {
+				return err
+			}
+			found = true
+		}
+	}
+	if !listMode && !found {
+		return ErrNotInArchive
+	}
+	if verify {
+		return releaseFile(out, w.(*os.File))
+	}
+	return nil
+}
+
+// DecryptArchiveAt is like DecryptArchive, it finds the entries through
+// the index of the archive and only decrypts the chunks it reads. It fails
+// with ErrUnsupportedFlags if the archive can only be read in order.
+func DecryptArchiveAt(in *io.SectionReader, out io.Writer, key *alex.PrivateKey, opts *alex.DecryptOptions) error {
+	h, err := alex.ParseHeader(io.NewSectionReader(in, 0, in.Size()))
+	if err != nil {
+		return err
+	}
+	if !h.Archive {
+		return alex.ErrNotArchive
+	}
+	dec, err := alex.NewDecryptReaderAtWithOptions(in, in.Size(), key, opts)
+	if err != nil {
+		return err
+	}
+	index, err := alex.ReadArchiveIndex(dec, dec.Size())
+	if err != nil {
+		return err
+	}
+	for _, entry := range index {
+		if listMode {
+			fmt.Fprintln(out, entry.Name)
+			continue
+		}
+		if entry.Name == extractPath && entry.Type == tar.TypeReg {
+			_, err := io.Copy(out, io.NewSectionReader(dec, entry.Offset, entry.Size))
+			return err
+		}
+	}
+	if listMode {
+		return nil
+	}
+	return ErrNotInArchive
+}
+
+// FileMetadata returns the metadata of an open file.
+func FileMetadata(f *os.File) (*alex.Metadata, error) {
+	info, err := f.Stat()
+	if err != nil {
+		return nil, err
+	}
+	return &alex.Metadata{
+		Name:        filepath.Base(f.Name()),
+		Mode:        info.Mode().Perm(),
+		ModTime:     info.ModTime(),
+		ContentType: mime.TypeByExtension(filepath.Ext(f.Name())),
+	}, nil
+}
+
+// Restore writes the message to a new file in the current directory, with
+// the name, mode and mtime in its metadata. The file is removed if the
+// message fails to decrypt.
+func Restore(in io.Reader, md *alex.Metadata) (err error) {
+	if md == nil {
+		return ErrNoMetadata
+	}
+	name := md.Name
+	if name != filepath.Base(name) || name == "." || name == ".." || name == string(filepath.Separator) {
+		return ErrBadFileName
+	}
+	debug("Restoring %s", name)
+
+	f, err := os.OpenFile(name, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0600)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		if cerr := f.Close(); err == nil {
+			err = cerr
+		}
+		if err != nil {
+			os.Remove(name)
+		}
+	}()
+	if _, err := io.Copy(f, in); err != nil {
+		return err
+	}
+	if err := f.Chmod(md.Mode.Perm()); err != nil {
+		return err
+	}
+	if !md.ModTime.IsZero() {
+		return os.Chtimes(name, md.ModTime, md.ModTime)
+	}
+	return nil
+}
+
+func Recrypt(in io.Reader, out io.Writer) error {
 	if privateKey == "" {
 		return ErrMissingPrivateKey
 	}
@@ -209,28 +604,90 @@ func Decrypt(in io.Reader, out io.Writer) error {
 	if err != nil {
 		return err
 	}
-	debug("Private key: %s", key)
-
-	message, err := ioutil.ReadAll(in)
+	add, err := peerKeys.DecodeKeys()
+	if err != nil {
+		return err
+	}
+	remove, err := removeKeys.DecodeKeys()
 	if err != nil {
-		// TODO improve error
 		return err
 	}
 
-	dec, err := alex.Decrypt(message, &key)
+	if debugMode {
+		debug("Private key %s", key)
+		for i, p := range add {
+			debug("%3d] + %s", i+1, p)
+		}
+		for i, p := range remove {
+			debug("%3d] - %s", i+1, p)
+		}
+	}
+
+	return alex.RecryptStream(out, in, &key, add, remove)
+}
+
+func Inspect(in io.Reader, out io.Writer) error {
+	var raw bytes.Buffer
+	h, err := alex.ParseHeader(io.TeeReader(in, &raw))
 	if err != nil {
-		// TODO: improve error
+		// the fields parsed before the error show where it is
+		if hexMode {
+			HexDump(out, raw.Bytes(), h.Fields)
+		}
 		return err
 	}
-	_, err = out.Write(dec)
+	payload, err := io.Copy(ioutil.Discard, in)
 	if err != nil {
-		// TODO: improve error
 		return err
 	}
 
+	yesNo := map[bool]string{true: "yes", false: "no"}
+	fmt.Fprintf(out, "version:       %d\n", h.Version)
+	fmt.Fprintf(out, "suite:         %s\n", h.Suite)
+	fmt.Fprintf(out, "sender:        %s\n", h.Sender)
+	fmt.Fprintf(out, "recipients:    %d\n", h.Recipients)
+	fmt.Fprintf(out, "signed:        %s\n", yesNo[h.Signed])
+	fmt.Fprintf(out, "authenticated: %s\n", yesNo[h.Authenticated])
+	fmt.Fprintf(out, "padded:        %s\n", yesNo[h.Padded])
+	fmt.Fprintf(out, "compressed:    %s\n", yesNo[h.Compressed])
+	fmt.Fprintf(out, "metadata:      %s\n", yesNo[h.HasMetadata])
+	fmt.Fprintf(out, "archive:       %s\n", yesNo[h.Archive])
+	fmt.Fprintf(out, "header:        %d bytes\n", h.PayloadOffset)
+	fmt.Fprintf(out, "payload:       %d bytes\n", payload)
+
+	if hexMode {
+		fmt.Fprintln(out)
+		HexDump(out, raw.Bytes(), h.Fields)
+	}
 	return nil
 }
 
+// HexDump writes data 16 bytes to a line, each field starting on a line of
+// its own labelled with its name. Bytes after the last field are labelled
+// unparsed.
+func HexDump(out io.Writer, data []byte, fields []alex.HeaderField) {
+	offset := 0
+	for _, f := range fields {
+		hexDumpField(out, data[f.Offset:f.Offset+f.Len], f.Offset, f.Name)
+		offset = f.Offset + f.Len
+	}
+	if offset < len(data) {
+		hexDumpField(out, data[offset:], offset, "unparsed")
+	}
+}
+
+func hexDumpField(out io.Writer, data []byte, offset int, name string) {
+	for i := 0; i < len(data); i += 16 {
+		end := i + 16
+		if end > len(data) {
+			end = len(data)
+		}
+		line := fmt.Sprintf("%06x  % -47x  %s", offset+i, data[i:end], name)
+		fmt.Fprintln(out, strings.TrimRight(line, " "))
+		name = ""
+	}
+}
+
 func Version(out io.Writer) {
 	fmt.Fprintln(out, `alex version:`, version)
 }
@@ -245,8 +702,12 @@ USAGE:
 COMMANDS:
   genkey            generate a new private key
   pubkey            generate public key from private key
+  signkey           generate a new signing key
+  verifykey         generate verify key from signing key
   encrypt, enc      encrypt a message
   decrypt, dec      decrypt a message
+  recrypt           add or remove recipients of a message
+  inspect           show the header of a message
   version           show version info
   help              show help for a command
 
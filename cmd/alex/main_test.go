@@ -4,8 +4,13 @@ import (
 	"bytes"
 	"crypto/rand"
 	"encoding/base64"
-	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
 	"testing"
+	"time"
 
 	"desource.net/alex"
 )
@@ -83,9 +88,17 @@ func TestEncryptMessage(t *testing.T) {
 
 	err := Encrypt(in, &out)
 	if err != nil {
-		t.Errorf("Unexpected error %s", err)
+		t.Fatalf("Unexpected error %s", err)
+	}
+
+	// encryption is randomized, so the envelope is checked by decrypting it
+	var dec bytes.Buffer
+	if err := Decrypt(&out, &dec); err != nil {
+		t.Fatalf("Unexpected decrypt error %s", err)
+	}
+	if dec.String() != exampleMsg {
+		t.Errorf("Expected to be equal\n'%s'\n'%s'", dec.String(), exampleMsg)
 	}
-	t.Logf("Message: %s", base64.RawStdEncoding.EncodeToString(out.Bytes()))
 }
 
 func TestDecryptMessage(t *testing.T) {
@@ -142,8 +155,6 @@ func TestEncryptAndDecryptMultipeRecipients(t *testing.T) {
 		t.Fatalf("Unexpected encrypt error: %s", err)
 	}
 
-	fmt.Println("Message:", base64.RawStdEncoding.EncodeToString(enc.Bytes()), "\n")
-
 	privateKey = privateKey1.String()
 	tmpEncode := bytes.NewBuffer(enc.Bytes())
 	if err := Decrypt(tmpEncode, &dec); err != nil {
@@ -177,7 +188,529 @@ func TestEncryptAndDecryptMultipeRecipients(t *testing.T) {
 	}
 }
 
+func TestEncryptAndDecryptSigned(t *testing.T) {
+	in := bytes.NewBufferString(exampleMsg)
+	var enc bytes.Buffer
+	var dec bytes.Buffer
+	defer resetKeys()
+
+	key, _ := alex.GenerateSigningKey(rand.Reader)
+	otherKey, _ := alex.GenerateSigningKey(rand.Reader)
+
+	privateKey = examplePrivateKey
+	peerKeys = []string{examplePublicKey}
+	signingKey = key.String()
+	if err := Encrypt(in, &enc); err != nil {
+		t.Fatalf("Unexpected encrypt error: %s", err)
+	}
+
+	signerKey = otherKey.VerifyKey().String()
+	if err := Decrypt(bytes.NewReader(enc.Bytes()), &dec); err != alex.ErrUnexpectedSigner {
+		t.Fatalf("Expected %s but got %v", alex.ErrUnexpectedSigner, err)
+	}
+
+	signerKey = key.VerifyKey().String()
+	if err := Decrypt(bytes.NewReader(enc.Bytes()), &dec); err != nil {
+		t.Fatalf("Unexpected decrypt error: %s", err)
+	}
+	if dec.String() != exampleMsg {
+		t.Fatalf("Message not equal\n`%s`\n`%s`", dec.String(), exampleMsg)
+	}
+
+	// nothing of a message over several chunks is written before its
+	// signature is verified
+	enc.Reset()
+	if err := Encrypt(bytes.NewReader(make([]byte, 200*1024)), &enc); err != nil {
+		t.Fatalf("Unexpected encrypt error: %s", err)
+	}
+	forged := enc.Bytes()
+	forged[len(forged)-1] ^= 1
+	dec.Reset()
+	if err := Decrypt(bytes.NewReader(forged), &dec); err != alex.ErrBadSignature {
+		t.Fatalf("Expected %s but got %v", alex.ErrBadSignature, err)
+	}
+	if dec.Len() != 0 {
+		t.Errorf("Expected no output but got %d bytes", dec.Len())
+	}
+}
+
+func TestEncryptAndDecryptAuthenticated(t *testing.T) {
+	in := bytes.NewBufferString(exampleMsg)
+	var enc bytes.Buffer
+	var dec bytes.Buffer
+	defer resetKeys()
+
+	otherKey, _ := alex.GeneratePrivateKey(rand.Reader)
+
+	privateKey = examplePrivateKey
+	peerKeys = []string{examplePublicKey}
+	authMode = true
+	if err := Encrypt(in, &enc); err != nil {
+		t.Fatalf("Unexpected encrypt error: %s", err)
+	}
+
+	senderKey = otherKey.PublicKey().String()
+	if err := Decrypt(bytes.NewReader(enc.Bytes()), &dec); err != alex.ErrUnexpectedSender {
+		t.Fatalf("Expected %s but got %v", alex.ErrUnexpectedSender, err)
+	}
+
+	senderKey = examplePublicKey
+	if err := Decrypt(bytes.NewReader(enc.Bytes()), &dec); err != nil {
+		t.Fatalf("Unexpected decrypt error: %s", err)
+	}
+	if dec.String() != exampleMsg {
+		t.Fatalf("Message not equal\n`%s`\n`%s`", dec.String(), exampleMsg)
+	}
+
+	// nothing of a message over several chunks is written before its
+	// sender is verified
+	enc.Reset()
+	if err := Encrypt(bytes.NewReader(make([]byte, 200*1024)), &enc); err != nil {
+		t.Fatalf("Unexpected encrypt error: %s", err)
+	}
+	forged := enc.Bytes()
+	forged[len(forged)-1] ^= 1
+	dec.Reset()
+	if err := Decrypt(bytes.NewReader(forged), &dec); err != alex.ErrBadAuthenticator {
+		t.Fatalf("Expected %s but got %v", alex.ErrBadAuthenticator, err)
+	}
+	if dec.Len() != 0 {
+		t.Errorf("Expected no output but got %d bytes", dec.Len())
+	}
+}
+
+func TestEncryptAndDecryptPadRecipients(t *testing.T) {
+	in := bytes.NewBufferString(exampleMsg)
+	var enc bytes.Buffer
+	var dec bytes.Buffer
+	defer resetKeys()
+
+	otherKey, _ := alex.GeneratePrivateKey(rand.Reader)
+
+	privateKey = examplePrivateKey
+	peerKeys = []string{otherKey.PublicKey().String(), examplePublicKey, examplePublicKey}
+	padMode = true
+	if err := Encrypt(in, &enc); err != nil {
+		t.Fatalf("Unexpected encrypt error: %s", err)
+	}
+
+	if err := Decrypt(&enc, &dec); err != nil {
+		t.Fatalf("Unexpected decrypt error: %s", err)
+	}
+	if dec.String() != exampleMsg {
+		t.Fatalf("Message not equal\n`%s`\n`%s`", dec.String(), exampleMsg)
+	}
+}
+
+func TestEncryptAndDecryptPad(t *testing.T) {
+	var enc, short bytes.Buffer
+	var dec bytes.Buffer
+	defer resetKeys()
+
+	privateKey = examplePrivateKey
+	padLength = true
+	if err := Encrypt(bytes.NewBufferString(exampleMsg), &enc); err != nil {
+		t.Fatalf("Unexpected encrypt error: %s", err)
+	}
+	if err := Encrypt(bytes.NewBufferString("yes"), &short); err != nil {
+		t.Fatalf("Unexpected encrypt error: %s", err)
+	}
+	if enc.Len() != short.Len() {
+		t.Errorf("Expected envelopes of the same length, got %d and %d", enc.Len(), short.Len())
+	}
+
+	if err := Decrypt(&enc, &dec); err != nil {
+		t.Fatalf("Unexpected decrypt error: %s", err)
+	}
+	if dec.String() != exampleMsg {
+		t.Fatalf("Message not equal\n`%s`\n`%s`", dec.String(), exampleMsg)
+	}
+}
+
+func TestEncryptAndDecryptCompress(t *testing.T) {
+	in := bytes.NewBufferString(exampleMsg)
+	var enc bytes.Buffer
+	var dec bytes.Buffer
+	defer resetKeys()
+
+	privateKey = examplePrivateKey
+	compress = true
+	if err := Encrypt(in, &enc); err != nil {
+		t.Fatalf("Unexpected encrypt error: %s", err)
+	}
+
+	if err := Decrypt(&enc, &dec); err != nil {
+		t.Fatalf("Unexpected decrypt error: %s", err)
+	}
+	if dec.String() != exampleMsg {
+		t.Fatalf("Message not equal\n`%s`\n`%s`", dec.String(), exampleMsg)
+	}
+}
+
+func TestEncryptAndDecryptRestore(t *testing.T) {
+	var enc, enc2 bytes.Buffer
+	defer resetKeys()
+
+	src := filepath.Join(t.TempDir(), "report.txt")
+	if err := ioutil.WriteFile(src, []byte(exampleMsg), 0640); err != nil {
+		t.Fatal(err)
+	}
+	mtime := time.Date(2020, 3, 1, 12, 30, 0, 0, time.UTC)
+	if err := os.Chtimes(src, mtime, mtime); err != nil {
+		t.Fatal(err)
+	}
+	f, err := os.Open(src)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+
+	privateKey = examplePrivateKey
+	if metadata, err = FileMetadata(f); err != nil {
+		t.Fatal(err)
+	}
+	if err := Encrypt(f, &enc); err != nil {
+		t.Fatalf("Unexpected encrypt error: %s", err)
+	}
+
+	t.Chdir(t.TempDir())
+	restore = true
+	if err := Decrypt(bytes.NewReader(enc.Bytes()), ioutil.Discard); err != nil {
+		t.Fatalf("Unexpected decrypt error: %s", err)
+	}
+	dec, err := ioutil.ReadFile("report.txt")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(dec) != exampleMsg {
+		t.Fatalf("Message not equal\n`%s`\n`%s`", dec, exampleMsg)
+	}
+	info, err := os.Stat("report.txt")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info.Mode().Perm() != 0640 || !info.ModTime().Equal(mtime) {
+		t.Errorf("Expected mode 0640 and mtime %s but got %s and %s", mtime, info.Mode(), info.ModTime())
+	}
+
+	// never overwrite a file
+	if err := Decrypt(bytes.NewReader(enc.Bytes()), ioutil.Discard); !os.IsExist(err) {
+		t.Errorf("Expected the file to exist but got %v", err)
+	}
+
+	metadata = nil
+	if err := Encrypt(bytes.NewBufferString(exampleMsg), &enc2); err != nil {
+		t.Fatalf("Unexpected encrypt error: %s", err)
+	}
+	if err := Decrypt(&enc2, ioutil.Discard); err != ErrNoMetadata {
+		t.Errorf("Expected %s but got %v", ErrNoMetadata, err)
+	}
+}
+
+func TestEncryptAndDecryptArchive(t *testing.T) {
+	var enc, list, file bytes.Buffer
+	defer resetKeys()
+
+	root := t.TempDir()
+	if err := os.Mkdir(filepath.Join(root, "nginx"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(filepath.Join(root, "nginx", "nginx.conf"), []byte(exampleMsg), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	privateKey = examplePrivateKey
+	archiveDir = root
+	if err := Encrypt(nil, &enc); err != nil {
+		t.Fatalf("Unexpected encrypt error: %s", err)
+	}
+
+	// a file is read by its index
+	name := filepath.Join(t.TempDir(), "nginx.alex")
+	if err := ioutil.WriteFile(name, enc.Bytes(), 0600); err != nil {
+		t.Fatal(err)
+	}
+	for _, open := range []func() io.Reader{
+		func() io.Reader { return bytes.NewReader(enc.Bytes()) },
+		func() io.Reader {
+			f, err := os.Open(name)
+			if err != nil {
+				t.Fatal(err)
+			}
+			t.Cleanup(func() { f.Close() })
+			return f
+		},
+	} {
+		list.Reset()
+		file.Reset()
+
+		listMode, extractPath = true, ""
+		if err := Decrypt(open(), &list); err != nil {
+			t.Fatalf("Unexpected decrypt error: %s", err)
+		}
+		if list.String() != "nginx/\nnginx/nginx.conf\n" {
+			t.Errorf("Unexpected list\n%s", list.String())
+		}
+
+		listMode = false
+		extractPath = "nginx/nginx.conf"
+		if err := Decrypt(open(), &file); err != nil {
+			t.Fatalf("Unexpected decrypt error: %s", err)
+		}
+		if file.String() != exampleMsg {
+			t.Fatalf("Message not equal\n`%s`\n`%s`", file.String(), exampleMsg)
+		}
+
+		extractPath = "nginx/missing.conf"
+		if err := Decrypt(open(), ioutil.Discard); err != ErrNotInArchive {
+			t.Errorf("Expected %s but got %v", ErrNotInArchive, err)
+		}
+	}
+
+	// a signed archive is read in order, to verify it
+	key, _ := alex.GenerateSigningKey(rand.Reader)
+	signingKey = key.String()
+	enc.Reset()
+	if err := Encrypt(nil, &enc); err != nil {
+		t.Fatalf("Unexpected encrypt error: %s", err)
+	}
+	f, err := os.Create(name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	if _, err := f.Write(enc.Bytes()); err != nil {
+		t.Fatal(err)
+	}
+	k, _ := alex.DecodePrivateKey(examplePrivateKey)
+	if err := DecryptArchiveAt(io.NewSectionReader(f, 0, int64(enc.Len())), ioutil.Discard, &k, nil); err != alex.ErrUnsupportedFlags {
+		t.Errorf("Expected %s but got %v", alex.ErrUnsupportedFlags, err)
+	}
+	f.Seek(0, io.SeekStart)
+	list.Reset()
+	listMode, extractPath = true, ""
+	if err := Decrypt(f, &list); err != nil || list.String() != "nginx/\nnginx/nginx.conf\n" {
+		t.Errorf("Unexpected list %q: %v", list.String(), err)
+	}
+}
+
+func TestEncryptAndDecryptJobs(t *testing.T) {
+	msg := strings.Repeat(exampleMsg, 2000)
+	var enc bytes.Buffer
+	var dec bytes.Buffer
+	defer resetKeys()
+
+	privateKey = examplePrivateKey
+	jobs = 4
+	if err := Encrypt(bytes.NewBufferString(msg), &enc); err != nil {
+		t.Fatalf("Unexpected encrypt error: %s", err)
+	}
+
+	if err := Decrypt(&enc, &dec); err != nil {
+		t.Fatalf("Unexpected decrypt error: %s", err)
+	}
+	if dec.String() != msg {
+		t.Fatal("Message not equal")
+	}
+}
+
+func TestEncryptAndDecryptChaCha(t *testing.T) {
+	in := bytes.NewBufferString(exampleMsg)
+	var enc bytes.Buffer
+	var dec bytes.Buffer
+	defer resetKeys()
+
+	privateKey = examplePrivateKey
+	cipherName = "des"
+	if err := Encrypt(in, &enc); err != ErrUnknownCipher {
+		t.Fatalf("Expected %s but got %v", ErrUnknownCipher, err)
+	}
+
+	cipherName = "chacha"
+	if err := Encrypt(in, &enc); err != nil {
+		t.Fatalf("Unexpected encrypt error: %s", err)
+	}
+	if err := Decrypt(&enc, &dec); err != nil {
+		t.Fatalf("Unexpected decrypt error: %s", err)
+	}
+	if dec.String() != exampleMsg {
+		t.Fatalf("Message not equal\n`%s`\n`%s`", dec.String(), exampleMsg)
+	}
+}
+
+func TestEncryptAndDecryptContext(t *testing.T) {
+	in := bytes.NewBufferString(exampleMsg)
+	var enc bytes.Buffer
+	var dec bytes.Buffer
+	defer resetKeys()
+
+	privateKey = examplePrivateKey
+	context = "users/42"
+	if err := Encrypt(in, &enc); err != nil {
+		t.Fatalf("Unexpected encrypt error: %s", err)
+	}
+
+	context = "users/43"
+	if err := Decrypt(bytes.NewReader(enc.Bytes()), &dec); err != alex.ErrFailedToDecrypt {
+		t.Fatalf("Expected %s but got %v", alex.ErrFailedToDecrypt, err)
+	}
+
+	context = "users/42"
+	if err := Decrypt(bytes.NewReader(enc.Bytes()), &dec); err != nil {
+		t.Fatalf("Unexpected decrypt error: %s", err)
+	}
+	if dec.String() != exampleMsg {
+		t.Fatalf("Message not equal\n`%s`\n`%s`", dec.String(), exampleMsg)
+	}
+}
+
+func TestInspect(t *testing.T) {
+	in := bytes.NewBufferString(exampleMsg)
+	var enc bytes.Buffer
+	var out bytes.Buffer
+	defer resetKeys()
+
+	otherKey, _ := alex.GeneratePrivateKey(rand.Reader)
+
+	privateKey = examplePrivateKey
+	peerKeys = []string{examplePublicKey, otherKey.PublicKey().String()}
+	authMode = true
+	if err := Encrypt(in, &enc); err != nil {
+		t.Fatalf("Unexpected encrypt error: %s", err)
+	}
+
+	hexMode = true
+	if err := Inspect(bytes.NewReader(enc.Bytes()), &out); err != nil {
+		t.Fatalf("Unexpected inspect error: %s", err)
+	}
+	for _, s := range []string{
+		"sender:        " + examplePublicKey,
+		"recipients:    2",
+		"authenticated: yes",
+		"  slot 2",
+	} {
+		if !strings.Contains(out.String(), s) {
+			t.Errorf("Expected %q in\n%s", s, out.String())
+		}
+	}
+
+	out.Reset()
+	if err := Inspect(bytes.NewReader(enc.Bytes()[:80]), &out); err != alex.ErrTruncated {
+		t.Fatalf("Expected %s but got %v", alex.ErrTruncated, err)
+	}
+	for _, s := range []string{"  magic", "  sender", "  recipients", "  unparsed"} {
+		if !strings.Contains(out.String(), s) {
+			t.Errorf("Expected %q in\n%s", s, out.String())
+		}
+	}
+	if strings.Contains(out.String(), "  slot 1") {
+		t.Errorf("Expected the truncated slot to be unparsed in\n%s", out.String())
+	}
+}
+
+func TestRecrypt(t *testing.T) {
+	in := bytes.NewBufferString(exampleMsg)
+	var enc bytes.Buffer
+	var recrypted bytes.Buffer
+	var dec bytes.Buffer
+	defer resetKeys()
+
+	otherKey, _ := alex.GeneratePrivateKey(rand.Reader)
+
+	privateKey = examplePrivateKey
+	peerKeys = []string{examplePublicKey, otherKey.PublicKey().String()}
+	if err := Encrypt(in, &enc); err != nil {
+		t.Fatalf("Unexpected encrypt error: %s", err)
+	}
+
+	peerKeys = nil
+	removeKeys = []string{otherKey.PublicKey().String()}
+	if err := Recrypt(&enc, &recrypted); err != nil {
+		t.Fatalf("Unexpected recrypt error: %s", err)
+	}
+
+	privateKey = otherKey.String()
+	if err := Decrypt(bytes.NewReader(recrypted.Bytes()), &dec); err != alex.ErrFailedToDecrypt {
+		t.Fatalf("Expected %s but got %v", alex.ErrFailedToDecrypt, err)
+	}
+
+	privateKey = examplePrivateKey
+	if err := Decrypt(bytes.NewReader(recrypted.Bytes()), &dec); err != nil {
+		t.Fatalf("Unexpected decrypt error: %s", err)
+	}
+	if dec.String() != exampleMsg {
+		t.Fatalf("Message not equal\n`%s`\n`%s`", dec.String(), exampleMsg)
+	}
+}
+
+func TestRecryptAnonymous(t *testing.T) {
+	in := bytes.NewBufferString(exampleMsg)
+	var enc bytes.Buffer
+	var recrypted bytes.Buffer
+	var dec bytes.Buffer
+	defer resetKeys()
+
+	otherKey, _ := alex.GeneratePrivateKey(rand.Reader)
+
+	peerKeys = []string{examplePublicKey}
+	if err := Encrypt(in, &enc); err != nil {
+		t.Fatalf("Unexpected encrypt error: %s", err)
+	}
+
+	// the recipient sends it on
+	privateKey = examplePrivateKey
+	peerKeys = []string{otherKey.PublicKey().String()}
+	if err := Recrypt(&enc, &recrypted); err != nil {
+		t.Fatalf("Unexpected recrypt error: %s", err)
+	}
+
+	privateKey = otherKey.String()
+	if err := Decrypt(bytes.NewReader(recrypted.Bytes()), &dec); err != nil {
+		t.Fatalf("Unexpected decrypt error: %s", err)
+	}
+	if dec.String() != exampleMsg {
+		t.Fatalf("Message not equal\n`%s`\n`%s`", dec.String(), exampleMsg)
+	}
+}
+
 func resetKeys() {
 	privateKey = ""
 	peerKeys = []string{}
+	removeKeys = []string{}
+	signingKey = ""
+	signerKey = ""
+	senderKey = ""
+	authMode = false
+	padMode = false
+	padLength = false
+	compress = false
+	metadata = nil
+	restore = false
+	archiveDir = ""
+	listMode = false
+	extractPath = ""
+	jobs = 0
+	cipherName = ""
+	context = ""
+	hexMode = false
+}
+
+func TestEncryptAnonymous(t *testing.T) {
+	in := bytes.NewBufferString(exampleMsg)
+	var enc bytes.Buffer
+	var dec bytes.Buffer
+	peerKeys = []string{examplePublicKey}
+	defer resetKeys()
+
+	if err := Encrypt(in, &enc); err != nil {
+		t.Fatalf("Unexpected encrypt error: %s", err)
+	}
+
+	privateKey = examplePrivateKey
+	if err := Decrypt(&enc, &dec); err != nil {
+		t.Fatalf("Unexpected decrypt error: %s", err)
+	}
+	if dec.String() != exampleMsg {
+		t.Fatalf("Message not equal\n`%s`\n`%s`", dec.String(), exampleMsg)
+	}
 }
@@ -0,0 +1,65 @@
+package alex
+
+import (
+	"bufio"
+	"compress/flate"
+	"io"
+)
+
+// A compressed envelope sets flagCompressed, its payload is the plaintext
+// compressed with DEFLATE (RFC 1951) and then chunked and sealed as usual.
+// The flag is part of the header, which every slot is bound to, so it
+// can't be changed without failing to decrypt.
+
+// compressWriter compresses everything written to it into the
+// encryptWriter.
+type compressWriter struct {
+	*flate.Writer
+	e *encryptWriter
+}
+
+func newCompressWriter(e *encryptWriter) *compressWriter {
+	fw, _ := flate.NewWriter(e, flate.DefaultCompression)
+	return &compressWriter{fw, e}
+}
+
+// Close writes the end of the compressed stream and closes the
+// encryptWriter.
+func (c *compressWriter) Close() error {
+	if err := c.Writer.Close(); err != nil {
+		c.e.Abort()
+		return err
+	}
+	return c.e.Close()
+}
+
+// Abort aborts the encryptWriter, what is left of the compressed stream is
+// dropped.
+func (c *compressWriter) Abort() error {
+	return c.e.Abort()
+}
+
+// decompressReader decompresses the plaintext of a decryptReader.
+type decompressReader struct {
+	r  io.Reader
+	br *bufio.Reader // plaintext, read a byte at a time by r
+}
+
+func newDecompressReader(d *decryptReader) *decompressReader {
+	br := bufio.NewReader(d)
+	return &decompressReader{flate.NewReader(br), br}
+}
+
+func (c *decompressReader) Read(p []byte) (int, error) {
+	n, err := c.r.Read(p)
+	if err == io.EOF {
+		// the compressed stream has to end with the payload
+		if _, err := c.br.ReadByte(); err != io.EOF {
+			if err == nil {
+				err = ErrTrailingData
+			}
+			return n, err
+		}
+	}
+	return n, err
+}
@@ -1,71 +1,304 @@
 package alex
 
 import (
-	"crypto/aes"
-	"crypto/cipher"
+	"bytes"
+	"encoding/binary"
+	"io"
+
+	"desource.net/alex/pkg/chacha20poly1305"
 )
 
+// DecryptOptions holds the requirements a message has to meet to be
+// decrypted.
+type DecryptOptions struct {
+	// Signer requires the message to be signed by this key.
+	Signer *VerifyKey
+
+	// Sender requires the message to be authenticated as sent from this
+	// key.
+	Sender *PublicKey
+
+	// AD is the associated data the message was encrypted with.
+	AD []byte
+
+	// Jobs is the number of chunks opened in parallel, one if zero. With
+	// more than one, the frames are read ahead of Read by a goroutine and
+	// opened by a worker per job, which stop once the message is read,
+	// fails or the reader is closed. Each job holds two chunks in memory.
+	Jobs int
+}
+
+// jobs returns the number of chunks opened in parallel.
+func (opts *DecryptOptions) jobs() int {
+	if opts == nil || opts.Jobs < 1 {
+		return 1
+	}
+	return opts.Jobs
+}
+
+// check checks the requirements which can be met by the header alone.
+func (opts *DecryptOptions) check(h *header) error {
+	switch {
+	case opts == nil:
+		return nil
+	case opts.Signer != nil && h.flags&flagSigned == 0:
+		return ErrNotSigned
+	case opts.Sender != nil && h.flags&flagAuthenticated == 0:
+		return ErrNotAuthenticated
+	case opts.Sender != nil && *opts.Sender != h.sender:
+		return ErrUnexpectedSender
+	case len(opts.AD) > 0 && h.version < version4:
+		// not bound to any associated data
+		return ErrFailedToDecrypt
+	}
+	return nil
+}
+
+// Decrypt decrypts an envelope with the private key of one of its
+// recipients. A compressed message is decompressed, so it may be far
+// larger than the envelope.
 func Decrypt(data []byte, privateKey *PrivateKey) (out []byte, err error) {
-	var nonce [aes.BlockSize]byte
-	copy(nonce[:], data[:aes.BlockSize])
+	out, _, err = decrypt(nil, data, privateKey, nil)
+	return out, err
+}
 
-	var peerPublicKey PublicKey
-	copy(peerPublicKey[:], data[aes.BlockSize:])
+// DecryptWithOptions is like Decrypt, with the requirements in opts.
+func DecryptWithOptions(data []byte, privateKey *PrivateKey, opts *DecryptOptions) (out []byte, err error) {
+	out, _, err = decrypt(nil, data, privateKey, opts)
+	return out, err
+}
 
-	offset := aes.BlockSize + len(peerPublicKey)
-	recipients, i := readRecipientCount(data[offset:]) // TODO check for overflow
-	offset += i + 1
+// DecryptWithIdentity is like DecryptWithOptions, with the session key
+// unwrapped by identity.
+func DecryptWithIdentity(data []byte, identity Identity, opts *DecryptOptions) (out []byte, err error) {
+	out, _, err = decrypt(nil, data, identity, opts)
+	return out, err
+}
 
-	message := data[(offset + (int(recipients) * sessionKeyLen)):]
+// DecryptVerified decrypts a signed message and returns it with the key
+// which verified the signature. It fails with ErrNotSigned if the message
+// is not signed.
+func DecryptVerified(data []byte, privateKey *PrivateKey) (out []byte, signer *VerifyKey, err error) {
+	out, d, err := decrypt(nil, data, privateKey, nil)
+	if err != nil {
+		return nil, nil, err
+	}
+	if d == nil || d.signer == nil {
+		return nil, nil, ErrNotSigned
+	}
+	return out, d.signer, nil
+}
 
-	// for each recipient
-	for r := 0; r < int(recipients); r++ {
-		shared := privateKey.sharedKey(&peerPublicKey)
+// DecryptAuthenticated decrypts an authenticated message and returns it
+// with the public key of its sender. It fails with ErrNotAuthenticated if
+// the sender is not authenticated.
+func DecryptAuthenticated(data []byte, privateKey *PrivateKey) (out []byte, sender *PublicKey, err error) {
+	out, d, err := decrypt(nil, data, privateKey, nil)
+	if err != nil {
+		return nil, nil, err
+	}
+	if d == nil || d.sender == nil {
+		return nil, nil, ErrNotAuthenticated
+	}
+	return out, d.sender, nil
+}
 
-		sharedAes, err := aes.NewCipher(shared[:])
-		if err != nil {
-			return nil, err
+// DecryptWithMetadata is like DecryptWithOptions, and also returns the
+// metadata of the message, nil if it has none.
+func DecryptWithMetadata(data []byte, privateKey *PrivateKey, opts *DecryptOptions) (out []byte, md *Metadata, err error) {
+	out, d, err := decrypt(nil, data, privateKey, opts)
+	if err != nil {
+		return nil, nil, err
+	}
+	if d != nil {
+		md = d.metadata
+	}
+	return out, md, nil
+}
+
+// DecryptTo is like DecryptWithOptions, it appends the message to dst and
+// returns the extended slice. If dst has the capacity for the message it
+// is used as is, so a buffer can be reused across messages. data is left
+// as it is, and the capacity of dst must not overlap it.
+//
+// As with EncryptTo a single chunk is opened in place in dst. The parsed
+// header, the session key, the ciphers, the hash which derives the slot key
+// and the slot passed to the Identity are still new for each envelope, that
+// is 15 small allocations for an envelope to one peer.
+func DecryptTo(dst, data []byte, privateKey *PrivateKey, opts *DecryptOptions) ([]byte, error) {
+	out, _, err := decrypt(dst, data, privateKey, opts)
+	if err != nil {
+		return dst, err
+	}
+	return out, nil
+}
+
+// decrypt appends the message in data to dst, and returns the reader of
+// chunked envelopes.
+func decrypt(dst, data []byte, identity Identity, opts *DecryptOptions) (out []byte, d *decryptReader, err error) {
+	h, err := sliceHeader(data)
+	if err != nil {
+		return nil, nil, err
+	}
+	message := data[len(h.raw):]
+
+	if h.version < version2 {
+		if err := opts.check(h); err != nil {
+			return nil, nil, err
 		}
-		var sessionKey sessionKey
-		iv := make([]byte, aes.BlockSize)
-		copy(iv, nonce[:])
-		// xor with a counter for each recipient
-		iv[0] = nonce[0] ^ byte(r)
-		iv[1] = nonce[1] ^ byte(r>>1)
-		iv[2] = nonce[2] ^ byte(r>>2)
-		iv[3] = nonce[3] ^ byte(r>>3)
-		stream := cipher.NewCTR(sharedAes, iv)
-		stream.XORKeyStream(sessionKey[:], data[offset:offset+len(sessionKey)])
-
-		offset += len(sessionKey)
-
-		sessionAes, err := aes.NewCipher(sessionKey[:])
+		privateKey, ok := identity.(*PrivateKey)
+		if !ok {
+			return nil, nil, ErrFailedToDecrypt
+		}
+		out, err = h.open(dst, message, privateKey)
+		return out, nil, err
+	}
+
+	if h.singleChunk(message) {
+		out, err = h.openSingle(dst, message, identity, opts)
+		return out, nil, err
+	}
+
+	d, err = newDecryptReader(h, bytes.NewReader(message), identity, opts)
+	if err != nil {
+		return nil, nil, err
+	}
+	content, err := d.content()
+	if err != nil {
+		return nil, nil, err
+	}
+	if dst == nil {
+		dst = make([]byte, 0, len(message))
+	}
+	if out, err = readAppend(dst, content); err != nil {
+		d.release()
+		return nil, nil, err
+	}
+	d.release()
+	return out, d, nil
+}
+
+// singleChunk returns whether the payload of the envelope is a single final
+// chunk, with nothing to verify or decode but its padding.
+func (h *header) singleChunk(payload []byte) bool {
+	return h.version >= version3 &&
+		h.flags&^(flagPadded|flagArchive) == 0 &&
+		len(payload) >= chunkPrefixLen+tagLen &&
+		len(payload) <= chunkPrefixLen+chunkSize+tagLen &&
+		binary.BigEndian.Uint32(payload) == finalChunkFlag
+}
+
+// openSingle appends the message of an envelope whose payload is a single
+// final chunk to dst, opened in place without a reader.
+func (h *header) openSingle(dst, payload []byte, identity Identity, opts *DecryptOptions) ([]byte, error) {
+	if err := opts.check(h); err != nil {
+		return nil, err
+	}
+	if k, ok := identity.(*PrivateKey); ok {
+		identity = &x25519Identity{k.sharedKey(&h.sender)}
+	}
+	key, _, err := h.unwrap(identity)
+	if err != nil {
+		return nil, err
+	}
+	aead, err := newAEAD(h.suite, key)
+	if err != nil {
+		return nil, err
+	}
+	var nonceBuf [chacha20poly1305.NonceSizeX]byte
+	finalNonce := nonceBuf[:aead.NonceSize()]
+	chunkNonce(finalNonce, h.nonce, 0, nonceFinalChunk)
+	var ad []byte
+	if opts != nil {
+		ad = associatedData(opts.AD)
+	}
+
+	out, err := aead.Open(dst, finalNonce, payload[chunkPrefixLen:], ad)
+	if err != nil {
+		return nil, ErrFailedToDecrypt
+	}
+	if h.flags&flagPadded != 0 {
+		content, err := unpad(out[len(dst):])
 		if err != nil {
 			return nil, err
 		}
-		aesgcm, _ := cipher.NewGCM(sessionAes)
+		out = out[:len(dst)+len(content)]
+	}
+	return out, nil
+}
 
-		out, err = aesgcm.Open(data[:0], nonce[:aesgcm.NonceSize()], message, nil)
-		if err == nil {
-			return out, nil
+// readAppend appends everything read from r to dst.
+func readAppend(dst []byte, r io.Reader) ([]byte, error) {
+	for {
+		if len(dst) == cap(dst) {
+			dst = append(dst, 0)[:len(dst)]
+		}
+		n, err := r.Read(dst[len(dst):cap(dst)])
+		dst = dst[:len(dst)+n]
+		if err == io.EOF {
+			return dst, nil
+		} else if err != nil {
+			return dst, err
 		}
-		// TODO improve error handling?
 	}
+}
 
-	return nil, ErrFailedToDecrypt
+// unwrap finds the slot the identity opens, and returns the session key
+// with the index of the slot.
+func (h *header) unwrap(identity Identity) (*sessionKey, int, error) {
+	if h.version < version4 {
+		x, ok := identity.(*x25519Identity)
+		if !ok {
+			return nil, 0, ErrFailedToDecrypt
+		}
+		return h.unwrapTagged(&x.shared)
+	}
+	for r, body := range h.slots {
+		if h.types[r] != identity.StanzaType() {
+			continue
+		}
+		key, err := identity.Unwrap(&Slot{
+			Suite:  Suite(h.suite),
+			Nonce:  h.nonce,
+			Sender: h.sender,
+			AD:     h.slotAD(),
+			Body:   body,
+		})
+		if err == ErrFailedToDecrypt {
+			continue
+		} else if err != nil {
+			return nil, 0, err
+		}
+		if len(key) != sessionKeyLen {
+			return nil, 0, ErrFailedToDecrypt
+		}
+		var sessionKey sessionKey
+		copy(sessionKey[:], key)
+		return &sessionKey, r, nil
+	}
+	return nil, 0, ErrFailedToDecrypt
 }
 
-func readRecipientCount(data []byte) (x uint16, i int) {
+// readRecipientCount decodes the varint recipient count at the start of
+// data, and returns it with the number of bytes read.
+func readRecipientCount(data []byte) (x uint16, n int, err error) {
 	var s uint
-	for ; ; i++ {
+	for i := 0; i < maxRecipientCountLen16; i++ {
+		if i >= len(data) {
+			return 0, 0, ErrTruncated
+		}
 		b := data[i]
 		if b < 0x80 {
-			if i >= maxRecipientCountLen16 || (i == maxRecipientCountLen16-1) && b > 1 {
-				return x, maxRecipientCountLen16 // overflow
+			if i == maxRecipientCountLen16-1 && b > 0x03 {
+				return 0, 0, ErrTooManyRecipients // overflows uint16
+			}
+			if i > 0 && b == 0 {
+				return 0, 0, ErrMalformedHeader // not minimally encoded
 			}
-			return x | uint16(b)<<s, i
+			return x | uint16(b)<<s, i + 1, nil
 		}
 		x |= uint16(b&0x7f) << s
 		s += 7
 	}
+	return 0, 0, ErrTooManyRecipients
 }
@@ -0,0 +1,328 @@
+package alex
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/base64"
+	"testing"
+)
+
+const (
+	examplePrivateKey = "Cw9S8tyzkzmyoKiRcx2E1JfhBKe93NbihtADv7DQbMzf"
+	exampleMsg        = "Hello World"
+)
+
+// a version 0 envelope of exampleMsg for examplePrivateKey
+var exampleLegacyEnvelope = "AW3N+2Gy/TI0d27+1p9ZxI9psgi6kQBK24Lb7DMI9SgCMSoWLIiX46P4wNmeSB5wAdYrkb9Yn4T0UTrDpCZnm7ZXouCxmnL5Dt2XpDDW6MBUCg/up1JfxqASqFaH3DyM52aHlty+4HWfEy0R"
+
+// a version 2 envelope of exampleMsg for examplePrivateKey, without slot
+// tags
+var exampleVersion2Envelope = "YWxleAIBAFgHTpQjgV7uQD03MaTb5aOPabIIupEAStuC2+wzCPUoAjEqFiyIl+Oj+MDZnkgecAGDILBPtWMjjvC8rES13ExFIqwY6W1cN12/2m0tlaK4GYAAAADwIMySS50Qp0mhpo6bSMrDf4y4/oDLfB33kHw"
+
+// a version 3 envelope of exampleMsg for examplePrivateKey, with AES-CTR
+// slots and slot tags
+var exampleVersion3Envelope = "YWxleAMBAAAxG4YdJ9pkNP0YgJccXWSPabIIupEAStuC2+wzCPUoAjEqFiyIl+Oj+MDZnkgecAFl+v2QEnwlrXiznvEtwoXW3m5b8fxocpU8gkdyxnvVA6Gdxwu/r82TGbURF4dGOfaAAAAAKoREd1RGq9N1lFPNyHaQ47qMc3VDbgGjflHc"
+
+// a version 4 envelope of exampleMsg for examplePrivateKey, with fixed
+// size slots
+var exampleVersion4Envelope = "YWxleAQBAJhygF9+CQVa0mPk13zXX/iPabIIupEAStuC2+wzCPUoAjEqFiyIl+Oj+MDZnkgecAE0VxA9aJo0V7n30B8JE2gcdIggAvEMfGrXYqeVMlElp/iyFgacEan5JNYZYxjHc2+AAAAAV4AklVcI1b0xvY7X8shaiZVIySROYyyJBvJe"
+
+func exampleKeys(t testing.TB) (*PrivateKey, *PublicKey) {
+	privateKey, err := DecodePrivateKey(examplePrivateKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	publicKey := privateKey.PublicKey()
+	return &privateKey, &publicKey
+}
+
+func TestDecryptLegacy(t *testing.T) {
+	privateKey, _ := exampleKeys(t)
+	for _, envelope := range []string{exampleLegacyEnvelope, exampleVersion2Envelope, exampleVersion3Envelope, exampleVersion4Envelope} {
+		enc, _ := base64.RawStdEncoding.DecodeString(envelope)
+
+		orig := append([]byte{}, enc...)
+		dec, err := Decrypt(enc, privateKey)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(dec) != exampleMsg {
+			t.Errorf("Expected to be equal\n'%s'\n'%s'", dec, exampleMsg)
+		}
+		if !bytes.Equal(enc, orig) {
+			t.Error("Expected the envelope to be left as it is")
+		}
+	}
+}
+
+func TestDecryptLegacyPayloadFlags(t *testing.T) {
+	privateKey, _ := exampleKeys(t)
+	for _, envelope := range []string{exampleVersion2Envelope, exampleVersion3Envelope, exampleVersion4Envelope} {
+		for _, flag := range []byte{flagPadded, flagCompressed, flagMetadata, flagArchive} {
+			enc, _ := base64.RawStdEncoding.DecodeString(envelope)
+			enc[len(magic)+2] |= flag
+			if _, err := Decrypt(enc, privateKey); err != ErrUnsupportedFlags {
+				t.Errorf("v%d, flag %#x: Expected %s but got %v", enc[len(magic)], flag, ErrUnsupportedFlags, err)
+			}
+			if _, err := NewDecryptReader(bytes.NewReader(enc), privateKey); err != ErrUnsupportedFlags {
+				t.Errorf("v%d, flag %#x: Expected %s but got %v", enc[len(magic)], flag, ErrUnsupportedFlags, err)
+			}
+		}
+	}
+}
+
+func TestEncryptToDecryptTo(t *testing.T) {
+	sender, _ := generateKeys(t)
+	recipient, recipientPublicKey := generateKeys(t)
+	signingKey, _ := GenerateSigningKey(testRand(0x24))
+
+	enc := make([]byte, 0, 4096)
+	dec := make([]byte, 0, 4096)
+	for _, msg := range [][]byte{[]byte(exampleMsg), make([]byte, 1000), make([]byte, chunkSize+1)} {
+		var err error
+		enc, err = EncryptTo(append(enc[:0], "prefix"...), msg, sender, &EncryptOptions{SigningKey: &signingKey}, recipientPublicKey)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(enc[:6]) != "prefix" {
+			t.Errorf("Expected the envelope to be appended to dst")
+		}
+		dec, err = DecryptTo(append(dec[:0], "prefix"...), enc[6:], recipient, nil)
+		if err != nil {
+			t.Fatalf("Unexpected decrypt error: %s", err)
+		}
+		if string(dec[:6]) != "prefix" || !bytes.Equal(dec[6:], msg) {
+			t.Errorf("Expected the message to be appended to dst")
+		}
+	}
+
+	// a buffer with room is used as is
+	enc, _ = EncryptTo(enc[:0], []byte(exampleMsg), sender, nil, recipientPublicKey)
+	buf := make([]byte, 0, 64)
+	if dec, err := DecryptTo(buf, enc, recipient, nil); err != nil || &dec[0] != &buf[:1][0] {
+		t.Errorf("Expected the message in dst but got %v", err)
+	}
+	if dec, err := DecryptTo(buf, enc[:len(enc)-1], recipient, nil); err == nil || len(dec) != 0 {
+		t.Errorf("Expected dst to be returned on error but got %q, %v", dec, err)
+	}
+}
+
+func TestEncryptToSingleChunk(t *testing.T) {
+	sender, _ := generateKeys(t)
+	recipient, recipientPublicKey := generateKeys(t)
+
+	// sealed in place, the envelope is the one the writer makes
+	for _, n := range []int{0, 100, chunkSize - 1, chunkSize} {
+		for _, pad := range []bool{false, true} {
+			msg := make([]byte, n)
+			rand.Read(msg)
+			enc, err := EncryptTo(nil, msg, sender, &EncryptOptions{Pad: pad, Rand: testRand(2)}, recipientPublicKey)
+			if err != nil {
+				t.Fatal(err)
+			}
+			var buf bytes.Buffer
+			w, err := NewEncryptWriterWithOptions(&buf, sender, &EncryptOptions{Pad: pad, Rand: testRand(2)}, recipientPublicKey)
+			if err != nil {
+				t.Fatal(err)
+			}
+			w.Write(msg)
+			if err := w.Close(); err != nil {
+				t.Fatal(err)
+			}
+			if !bytes.Equal(enc, buf.Bytes()) {
+				t.Errorf("%d, pad %v: Expected the envelope of the writer", n, pad)
+			}
+
+			dec, err := DecryptTo(nil, enc, recipient, nil)
+			if err != nil {
+				t.Fatalf("%d, pad %v: Unexpected decrypt error: %s", n, pad, err)
+			}
+			if !bytes.Equal(dec, msg) {
+				t.Errorf("%d, pad %v: Decrypted message not equal", n, pad)
+			}
+			enc[len(enc)-1] ^= 1
+			if _, err := DecryptTo(nil, enc, recipient, nil); err != ErrFailedToDecrypt {
+				t.Errorf("%d, pad %v: Expected %s but got %v", n, pad, ErrFailedToDecrypt, err)
+			}
+		}
+	}
+}
+
+func TestEncryptToDecryptToAllocs(t *testing.T) {
+	sender, _ := exampleKeys(t)
+	_, recipientPublicKey := exampleKeys(t)
+	msg := make([]byte, 256)
+	enc := make([]byte, 0, 1024)
+	dec := make([]byte, 0, 1024)
+
+	// the documented allocations, all of them needed by the ciphers and slots
+	if n := testing.AllocsPerRun(100, func() {
+		enc, _ = EncryptTo(enc[:0], msg, sender, nil, recipientPublicKey)
+	}); n > 12 {
+		t.Errorf("Expected at most 12 allocations to encrypt but got %v", n)
+	}
+	if n := testing.AllocsPerRun(100, func() {
+		dec, _ = DecryptTo(dec[:0], enc, sender, nil)
+	}); n > 15 {
+		t.Errorf("Expected at most 15 allocations to decrypt but got %v", n)
+	}
+	if !bytes.Equal(dec, msg) {
+		t.Error("Decrypted message not equal")
+	}
+}
+
+func BenchmarkEncryptTo(b *testing.B) {
+	sender, _ := exampleKeys(b)
+	_, recipientPublicKey := exampleKeys(b)
+	msg := make([]byte, 256)
+	enc := make([]byte, 0, 1024)
+	b.ReportAllocs()
+	b.SetBytes(int64(len(msg)))
+	for i := 0; i < b.N; i++ {
+		enc, _ = EncryptTo(enc[:0], msg, sender, nil, recipientPublicKey)
+	}
+}
+
+func BenchmarkDecryptTo(b *testing.B) {
+	recipient, recipientPublicKey := exampleKeys(b)
+	msg := make([]byte, 256)
+	enc, err := Encrypt(msg, recipient, recipientPublicKey)
+	if err != nil {
+		b.Fatal(err)
+	}
+	dec := make([]byte, 0, 1024)
+	b.ReportAllocs()
+	b.SetBytes(int64(len(msg)))
+	for i := 0; i < b.N; i++ {
+		if dec, err = DecryptTo(dec[:0], enc, recipient, nil); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func TestDecryptTamperedSlot(t *testing.T) {
+	privateKey, publicKey := exampleKeys(t)
+	other, _ := generateKeys(t)
+	enc, err := Encrypt([]byte(exampleMsg), privateKey, publicKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	h, err := readHeader(bytes.NewReader(enc))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// the slot is found, or not, from the header alone
+	if _, err := NewDecryptReader(bytes.NewReader(h.raw), other); err != ErrFailedToDecrypt {
+		t.Errorf("Expected %s but got %v", ErrFailedToDecrypt, err)
+	}
+	if _, err := NewDecryptReader(bytes.NewReader(h.raw), privateKey); err != ErrMissingFinalChunk {
+		t.Errorf("Expected %s but got %v", ErrMissingFinalChunk, err)
+	}
+
+	// the slot, and the nonce and sender it is bound to
+	for _, offset := range []int{prefixLen, prefixLen + len(h.nonce), len(h.raw) - 1} {
+		tampered := append([]byte(nil), h.raw...)
+		tampered[offset] ^= 1
+		if _, err := NewDecryptReader(bytes.NewReader(tampered), privateKey); err != ErrFailedToDecrypt {
+			t.Errorf("%d: Expected %s but got %v", offset, ErrFailedToDecrypt, err)
+		}
+	}
+}
+
+func TestDecryptTruncated(t *testing.T) {
+	privateKey, publicKey := exampleKeys(t)
+	enc, err := Encrypt([]byte(exampleMsg), privateKey, publicKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for i := 0; i < len(enc); i++ {
+		if _, err := Decrypt(enc[:i], privateKey); err == nil {
+			t.Errorf("Expected error decrypting %d of %d bytes", i, len(enc))
+		}
+	}
+}
+
+func TestReadRecipientCount(t *testing.T) {
+	for _, tc := range []struct {
+		data []byte
+		x    uint16
+		n    int
+		err  error
+	}{
+		{[]byte{0x00}, 0, 1, nil},
+		{[]byte{0x7f}, 127, 1, nil},
+		{[]byte{0x80, 0x01}, 128, 2, nil},
+		{[]byte{0xff, 0xff, 0x03}, 65535, 3, nil},
+		{[]byte{}, 0, 0, ErrTruncated},
+		{[]byte{0x80}, 0, 0, ErrTruncated},
+		{[]byte{0x80, 0x00}, 0, 0, ErrMalformedHeader},
+		{[]byte{0xff, 0xff, 0x04}, 0, 0, ErrTooManyRecipients},
+		{[]byte{0xff, 0xff, 0xff, 0x01}, 0, 0, ErrTooManyRecipients},
+	} {
+		x, n, err := readRecipientCount(tc.data)
+		if x != tc.x || n != tc.n || err != tc.err {
+			t.Errorf("%x: Expected (%d, %d, %v) but got (%d, %d, %v)", tc.data, tc.x, tc.n, tc.err, x, n, err)
+		}
+	}
+
+	var out [maxRecipientCountLen16]byte
+	for _, x := range []uint16{0, 1, 127, 128, 16383, 16384, 65535} {
+		l := writeRecipientCount(out[:], x)
+		if y, n, err := readRecipientCount(out[:l]); y != x || n != l || err != nil {
+			t.Errorf("%d: Expected to read back (%d, %d) but got (%d, %d, %v)", x, x, l, y, n, err)
+		}
+	}
+}
+
+func FuzzDecrypt(f *testing.F) {
+	privateKey, publicKey := exampleKeys(f)
+
+	legacy, _ := base64.RawStdEncoding.DecodeString(exampleLegacyEnvelope)
+	f.Add(legacy)
+	for _, n := range []int{0, len(exampleMsg), chunkSize + 1} {
+		enc, err := Encrypt(bytes.Repeat([]byte{'a'}, n), privateKey, publicKey, publicKey)
+		if err != nil {
+			f.Fatal(err)
+		}
+		f.Add(enc)
+	}
+
+	f.Fuzz(func(t *testing.T, data []byte) {
+		dec, err := Decrypt(data, privateKey)
+		if err != nil && dec != nil {
+			t.Errorf("Expected no plaintext with error %s", err)
+		}
+
+		r, err := NewDecryptReader(bytes.NewReader(data), privateKey)
+		if err != nil {
+			return
+		}
+		var buf bytes.Buffer
+		if _, err := buf.ReadFrom(r); err == nil && !bytes.Equal(buf.Bytes(), dec) {
+			t.Error("Expected Decrypt and NewDecryptReader to agree")
+		}
+	})
+}
+
+func FuzzReadRecipientCount(f *testing.F) {
+	f.Add([]byte{0x00})
+	f.Add([]byte{0x80, 0x01})
+	f.Add([]byte{0xff, 0xff, 0x03})
+	f.Add([]byte{0xff, 0xff, 0xff, 0x01})
+
+	f.Fuzz(func(t *testing.T, data []byte) {
+		x, n, err := readRecipientCount(data)
+		if err != nil {
+			return
+		}
+		if n > len(data) || n > maxRecipientCountLen16 {
+			t.Fatalf("Read %d bytes of %d", n, len(data))
+		}
+		var out [maxRecipientCountLen16]byte
+		if l := writeRecipientCount(out[:], x); !bytes.Equal(out[:l], data[:n]) {
+			t.Errorf("Expected %x to round trip, got %x", data[:n], out[:l])
+		}
+	})
+}
@@ -1,81 +1,456 @@
 package alex
 
 import (
-	"crypto/aes"
+	"bytes"
 	"crypto/cipher"
 	"crypto/rand"
+	"io"
+	"math"
+	"math/big"
+
+	"desource.net/alex/pkg/blake2b"
+	"desource.net/alex/pkg/chacha20poly1305"
 )
 
-// TODO move behind interface?
+// EncryptOptions holds the optional settings of an envelope, the zero value
+// is the same as calling Encrypt.
+type EncryptOptions struct {
+	// SigningKey signs the header and ciphertext. Only the recipients can
+	// see the signature and the key which verifies it.
+	SigningKey *SigningKey
+
+	// Authenticate proves the sender to each recipient with a tag keyed by
+	// the key they share. Unlike a signature the tag does not convince
+	// anyone else, as the recipient could have made it too. It needs a
+	// private key, anonymous messages can not be authenticated.
+	Authenticate bool
+
+	// Suite is the cipher of the envelope, SuiteAES256GCM if zero.
+	Suite Suite
+
+	// PadRecipients adds random slots up to the next power of two, and
+	// shuffles the slots, to hide how many recipients there are.
+	PadRecipients bool
+
+	// Pad hides the length of the message by padding it with Padmé, to at
+	// least 256 bytes. The padding is sealed with the message and is
+	// stripped by Decrypt.
+	Pad bool
+
+	// Compress compresses the message with DEFLATE before it is sealed,
+	// for text such as logs and JSON which would not compress once
+	// encrypted. The length of the envelope then depends on the content of
+	// the message, not just its length: when a message mixes a secret with
+	// data an attacker controls, they can learn the secret from how well
+	// their guesses compress with it, as in the CRIME and BREACH attacks
+	// on TLS and HTTP. Only compress messages no attacker can add to. Pad
+	// hides less of a compressed message, as it pads the compressed
+	// length.
+	Compress bool
+
+	// Metadata is sealed with the message, see DecryptWithMetadata.
+	Metadata *Metadata
+
+	// Recipients are given slots along with the peers, for recipients
+	// which are not X25519 keys.
+	Recipients []Recipient
+
+	// AD is associated data the envelope is bound to, such as a file path
+	// or a row ID. It is not stored in the envelope, the same data has to
+	// be given to decrypt it.
+	AD []byte
+
+	// Jobs is the number of chunks sealed in parallel, one if zero. With
+	// more than one, a worker per job seals chunks while the frames sealed
+	// before them are written in order. The envelope is the same for any
+	// number of jobs, each of which holds two chunks in memory.
+	Jobs int
+
+	// Rand is the source of the session key, nonce and any ephemeral key,
+	// crypto/rand.Reader if nil. It is meant for reproducible tests, an
+	// envelope is only as secret as its randomness.
+	Rand io.Reader
+}
+
+// suite returns the suite of the envelope.
+func (opts *EncryptOptions) suite() byte {
+	if opts == nil || opts.Suite == 0 {
+		return suiteX25519AES256GCM
+	}
+	return byte(opts.Suite)
+}
+
+// jobs returns the number of chunks sealed in parallel.
+func (opts *EncryptOptions) jobs() int {
+	if opts == nil || opts.Jobs < 1 {
+		return 1
+	}
+	return opts.Jobs
+}
+
+// random returns the source of randomness.
+func (opts *EncryptOptions) random() io.Reader {
+	if opts == nil || opts.Rand == nil {
+		return rand.Reader
+	}
+	return opts.Rand
+}
+
+// Encrypt encrypts plaintext for each of the peers. The envelope carries the
+// public key of privateKey, if privateKey is nil the message is sent
+// anonymously from a fresh ephemeral key.
 func Encrypt(plaintext []byte, privateKey *PrivateKey, peerPublicKeys ...*PublicKey) (out []byte, err error) {
-	// TODO validate peer public keys
+	return EncryptWithOptions(plaintext, privateKey, nil, peerPublicKeys...)
+}
 
-	var sessionKey sessionKey
-	if n, err := rand.Read(sessionKey[:]); err != nil {
-		return nil, err
-	} else if err == nil && n != len(sessionKey) {
-		return nil, ErrInsufficientEntropy
+// EncryptWithOptions is like Encrypt, with the optional settings in opts.
+func EncryptWithOptions(plaintext []byte, privateKey *PrivateKey, opts *EncryptOptions, peerPublicKeys ...*PublicKey) (out []byte, err error) {
+	out = make([]byte, 0, headerLen(version5, opts.suite(), len(peerPublicKeys))+payloadLen(len(plaintext)))
+	return EncryptTo(out, plaintext, privateKey, opts, peerPublicKeys...)
+}
+
+// EncryptTo is like EncryptWithOptions, it appends the envelope to dst and
+// returns the extended slice. If dst has the capacity for the envelope it
+// is used as is, so a buffer can be reused across messages. The capacity
+// of dst must not overlap plaintext.
+//
+// A message which fits in one chunk, and is not signed, authenticated,
+// compressed or with metadata, is sealed in place in dst. Other messages go
+// through the writer, with pooled chunk buffers, so the allocations don't
+// grow with the message. They are not zero: the session key, the AES or
+// ChaCha20 cipher of it and of each slot, the hash which derives the slot
+// key and the slot passed to the Recipient are new for each envelope, and
+// can't be pooled without keeping key material around. That is 12 small
+// allocations for one peer, and 6 more for each other peer.
+func EncryptTo(dst, plaintext []byte, privateKey *PrivateKey, opts *EncryptOptions, peerPublicKeys ...*PublicKey) ([]byte, error) {
+	publicKey, recipients, err := senderRecipients(privateKey, opts, peerPublicKeys)
+	if err != nil {
+		return dst, err
 	}
+	return sealTo(dst, plaintext, &publicKey, recipients, opts)
+}
 
-	sessionAes, err := aes.NewCipher(sessionKey[:])
+// sealTo appends the envelope of plaintext from publicKey to the
+// recipients to dst. A message which fits in a single chunk is sealed in
+// place, others through a writer.
+func sealTo(dst, plaintext []byte, publicKey *PublicKey, recipients []Recipient, opts *EncryptOptions) ([]byte, error) {
+	if opts.singleChunk(len(plaintext)) {
+		return sealSingle(dst, plaintext, publicKey, recipients, opts)
+	}
+	buf := bytes.NewBuffer(dst)
+	w, err := sealWriter(buf, publicKey, recipients, opts, 0)
 	if err != nil {
-		return nil, err
+		return dst, err
+	}
+	if _, err := w.Write(plaintext); err != nil {
+		w.Abort()
+		return dst, err
 	}
-	aesgcm, _ := cipher.NewGCM(sessionAes)
+	if err := w.Close(); err != nil {
+		return dst, err
+	}
+	return buf.Bytes(), nil
+}
 
-	publicKey := privateKey.PublicKey()
+// singleChunk returns whether a message of n bytes is sealed in a single
+// final chunk, with nothing in the envelope after it.
+func (opts *EncryptOptions) singleChunk(n int) bool {
+	if opts == nil {
+		return n <= chunkSize
+	}
+	if opts.SigningKey != nil || opts.Authenticate || opts.Compress || opts.Metadata != nil {
+		return false
+	}
+	if opts.Pad {
+		// the pad marker takes a byte
+		return paddedLen(int64(n)) < chunkSize
+	}
+	return n <= chunkSize
+}
 
-	nonceLen := aes.BlockSize //aesgcm.NonceSize()
+// sealSingle appends the envelope of a message which fits in a single chunk
+// to dst. The header and the chunk are sealed straight into dst, which is
+// grown at most once, so only the header and the ciphers allocate.
+func sealSingle(dst, plaintext []byte, publicKey *PublicKey, recipients []Recipient, opts *EncryptOptions) ([]byte, error) {
+	l := len(plaintext)
+	if opts != nil && opts.Pad {
+		l = int(paddedLen(int64(l))) + 1
+	}
+	n := len(recipients)
+	if opts != nil {
+		n += len(opts.Recipients)
+	}
+	if need := headerLen(version5, opts.suite(), n) + chunkPrefixLen + l + tagLen; cap(dst)-len(dst) < need {
+		grown := make([]byte, len(dst), len(dst)+need)
+		copy(grown, dst)
+		dst = grown
+	}
 
-	maxLen := nonceLen +
-		len(publicKey) +
-		maxRecipientCountLen16 +
-		(len(peerPublicKeys) * len(sessionKey)) +
-		aesgcm.Overhead() +
-		len(plaintext)
+	out, nonce, aead, _, err := sealEnvelope(dst, publicKey, recipients, opts, 0)
+	if err != nil {
+		return dst, err
+	}
+	var nonceBuf [chacha20poly1305.NonceSizeX]byte
+	finalNonce := nonceBuf[:aead.NonceSize()]
+	chunkNonce(finalNonce, nonce, 0, nonceFinalChunk)
+	var ad []byte
+	if opts != nil {
+		ad = associatedData(opts.AD)
+	}
 
-	out = make([]byte, maxLen)
+	out = append(out, finalChunkFlag>>24, 0, 0, 0)
+	if l == len(plaintext) {
+		return aead.Seal(out, finalNonce, plaintext, ad), nil
+	}
+	// the padding is sealed with the message, in place
+	start := len(out)
+	out = append(out, plaintext...)
+	out = append(out, padMarker)
+	for len(out)-start < l {
+		out = append(out, 0)
+	}
+	return aead.Seal(out[:start], finalNonce, out[start:], ad), nil
+}
 
-	if n, err := rand.Read(out[:nonceLen]); err != nil {
-		return nil, err
-	} else if n != nonceLen {
-		return nil, ErrInsufficientEntropy
+// senderRecipients returns the public key of the sender and a recipient for
+// each of the peers, as x25519Recipients does, once the options are
+// checked.
+func senderRecipients(privateKey *PrivateKey, opts *EncryptOptions, peerPublicKeys []*PublicKey) (PublicKey, []Recipient, error) {
+	if opts != nil && opts.Authenticate && privateKey == nil {
+		return PublicKey{}, nil, ErrAnonymousSender
 	}
-	nonce := out[:nonceLen]
-	offset := nonceLen
-	copy(out[nonceLen:], publicKey[:])
-	offset = offset + len(publicKey)
+	if len(peerPublicKeys) > math.MaxUint16 {
+		return PublicKey{}, nil, ErrTooManyRecipients
+	}
+	return x25519Recipients(opts.random(), privateKey, peerPublicKeys)
+}
 
-	l := writeRecipientCount(out[offset:], uint16(len(peerPublicKeys)))
-	offset = offset + l
-	out = out[:maxLen-(maxRecipientCountLen16-l)]
+// sealEnvelope appends the header of an envelope from publicKey to the
+// recipients, and to those of opts, to dst. It returns it with the nonce of
+// the header, the cipher of the session key and every recipient. flags are
+// set in the header along with those of opts.
+func sealEnvelope(dst []byte, publicKey *PublicKey, recipients []Recipient, opts *EncryptOptions, flags byte) (header, nonce []byte, aead cipher.AEAD, all []Recipient, err error) {
+	var extra []Recipient
+	pad := false
+	if opts != nil {
+		if opts.SigningKey != nil {
+			flags |= flagSigned
+		}
+		if opts.Authenticate {
+			flags |= flagAuthenticated
+		}
+		if opts.Pad {
+			flags |= flagPadded
+		}
+		if opts.Compress {
+			flags |= flagCompressed
+		}
+		extra, pad = opts.Recipients, opts.PadRecipients
+	}
+
+	if len(recipients)+len(extra) > math.MaxUint16 {
+		return nil, nil, nil, nil, ErrTooManyRecipients
+	}
+	random := opts.random()
+	all = recipients
+	if len(extra) > 0 {
+		// append to a copy, the recipients may be shared
+		all = append(recipients[:len(recipients):len(recipients)], extra...)
+	}
+	if pad {
+		if all, err = padRecipients(random, all); err != nil {
+			return nil, nil, nil, nil, err
+		}
+	}
+	suite := opts.suite()
+	if suite != suiteX25519AES256GCM && suite != suiteX25519XChaCha20Poly1305 {
+		return nil, nil, nil, nil, ErrUnsupportedSuite
+	}
+	header, nonce, key, err := sealHeader(dst, random, version5, suite, flags, publicKey, all)
+	if err != nil {
+		return nil, nil, nil, nil, err
+	}
+	if aead, err = newAEAD(suite, key); err != nil {
+		return nil, nil, nil, nil, err
+	}
+	return header, nonce, aead, all, nil
+}
 
-	iv := make([]byte, aes.BlockSize)
+// EncryptAnonymous encrypts plaintext for each of the peers from a fresh
+// ephemeral key, so the envelope does not reveal who sent it.
+func EncryptAnonymous(plaintext []byte, peerPublicKeys ...*PublicKey) ([]byte, error) {
+	return Encrypt(plaintext, nil, peerPublicKeys...)
+}
 
-	// For each recipient
+// x25519Recipients returns the public key of the sender and a recipient for
+// each of the peers. A nil privateKey is replaced by an ephemeral key.
+func x25519Recipients(random io.Reader, privateKey *PrivateKey, peerPublicKeys []*PublicKey) (publicKey PublicKey, recipients []Recipient, err error) {
+	// TODO validate peer public keys
+	if privateKey == nil {
+		ephemeralKey, err := GeneratePrivateKey(random)
+		if err != nil {
+			return publicKey, nil, err
+		}
+		privateKey = &ephemeralKey
+	}
+
+	recipients = make([]Recipient, len(peerPublicKeys))
+	x := make([]x25519Recipient, len(peerPublicKeys))
 	for r, peerPublicKey := range peerPublicKeys {
-		shared := privateKey.sharedKey(peerPublicKey)
+		x[r].shared = privateKey.sharedKey(peerPublicKey)
+		recipients[r] = &x[r]
+	}
+	return privateKey.PublicKey(), recipients, nil
+}
 
-		sharedAes, err := aes.NewCipher(shared[:])
+// padRecipients spreads the recipients over the next power of two slots in
+// a random order. The remaining slots are nil, and are filled with random
+// bytes which can't be told apart from a wrapped key.
+func padRecipients(random io.Reader, recipients []Recipient) ([]Recipient, error) {
+	n := 1
+	for n < len(recipients) {
+		n <<= 1
+	}
+	if n > math.MaxUint16 {
+		n = math.MaxUint16
+	}
+
+	padded := make([]Recipient, n)
+	copy(padded, recipients)
+	// Fisher-Yates shuffle
+	for i := n - 1; i > 0; i-- {
+		j, err := rand.Int(random, big.NewInt(int64(i+1)))
 		if err != nil {
 			return nil, err
 		}
-		copy(iv, []byte(nonce))
-		// xor with a counter for each recipient
-		iv[0] = nonce[0] ^ byte(r)
-		iv[1] = nonce[1] ^ byte(r>>1)
-		iv[2] = nonce[2] ^ byte(r>>2)
-		iv[3] = nonce[3] ^ byte(r>>3)
-		stream := cipher.NewCTR(sharedAes, iv)
-		stream.XORKeyStream(out[offset:], sessionKey[:])
+		padded[i], padded[j.Int64()] = padded[j.Int64()], padded[i]
+	}
+	return padded, nil
+}
+
+// sealHeader generates a new session key and returns it with the header
+// nonce and an envelope header wrapping the key for each of the
+// recipients, appended to dst. A nil recipient gets a random slot.
+func sealHeader(dst []byte, random io.Reader, version, suite, flags byte, publicKey *PublicKey, recipients []Recipient) (header []byte, nonce []byte, key *sessionKey, err error) {
+	var sessionKey sessionKey
+	if n, err := io.ReadFull(random, sessionKey[:]); err != nil {
+		return nil, nil, nil, err
+	} else if err == nil && n != len(sessionKey) {
+		return nil, nil, nil, ErrInsufficientEntropy
+	}
+
+	nonceLen := nonceLen(suite)
+
+	start, n := len(dst), headerLen(version, suite, len(recipients))
+	out := dst
+	if cap(out)-start < n {
+		out = make([]byte, start, start+n)
+		copy(out, dst)
+	}
+	out = out[:start+n]
+
+	offset := start + writePrefix(out[start:], version, suite, flags)
+
+	if n, err := io.ReadFull(random, out[offset:offset+nonceLen]); err != nil {
+		return nil, nil, nil, err
+	} else if n != nonceLen {
+		return nil, nil, nil, ErrInsufficientEntropy
+	}
+	nonce = out[offset : offset+nonceLen]
+	offset = offset + nonceLen
+	copy(out[offset:], publicKey[:])
+	offset = offset + len(publicKey)
+
+	ad := out[start:offset]
+
+	l := writeRecipientCount(out[offset:], uint16(len(recipients)))
+	offset = offset + l
+	out = out[:offset]
+
+	// For each recipient
+	for _, recipient := range recipients {
+		stanzaType, body := StanzaX25519, []byte(nil)
+		if recipient == nil {
+			body = make([]byte, x25519SlotLen)
+			if _, err := io.ReadFull(random, body); err != nil {
+				return nil, nil, nil, err
+			}
+		} else {
+			stanzaType = recipient.StanzaType()
+			body, err = recipient.Wrap(&Slot{
+				Suite:  Suite(suite),
+				Nonce:  nonce,
+				Sender: *publicKey,
+				AD:     ad,
+			}, sessionKey[:])
+			if err != nil {
+				return nil, nil, nil, err
+			}
+			if len(body) > math.MaxUint16 {
+				return nil, nil, nil, ErrSlotSize
+			}
+		}
+		out = appendSlot(out, version, stanzaType, body)
+	}
+
+	return out, nonce, &sessionKey, nil
+}
+
+// wrapKey derives the key which seals the session key for a recipient,
+// from the key they share with the sender and the header nonce.
+func wrapKey(shared *sharedKey, nonce []byte) *sessionKey {
+	h, _ := blake2b.New(&blake2b.Config{
+		Size:   sessionKeyLen,
+		Key:    shared[:],
+		Person: []byte("alex-wrap"),
+	})
+	h.Write(nonce)
+	var key sessionKey
+	h.Sum(key[:0])
+	return &key
+}
 
-		// update offset
-		offset = offset + len(sessionKey)
+// wrapNonce is the nonce of a wrap key, all zeros as the key is only used
+// once. It is long enough for any suite.
+var wrapNonce [chacha20poly1305.NonceSizeX]byte
+
+// wrapSessionKey seals the session key into a slot. The wrap key is only
+// used once, so the nonce is all zeros.
+func wrapSessionKey(suite byte, slot []byte, shared *sharedKey, nonce, ad, key []byte) error {
+	aead, err := newAEAD(suite, wrapKey(shared, nonce))
+	if err != nil {
+		return err
 	}
+	aead.Seal(slot[:0], wrapNonce[:aead.NonceSize()], key, ad)
+	return nil
+}
 
-	aesgcm.Seal(out[offset:offset], nonce[:aesgcm.NonceSize()], plaintext, nil)
+// associatedData returns the digest of the associated data which every
+// value sealed under the session key is bound to, or nil without any.
+func associatedData(ad []byte) []byte {
+	if len(ad) == 0 {
+		return nil
+	}
+	h, _ := blake2b.New(&blake2b.Config{
+		Size:   32,
+		Person: []byte("alex-ad"),
+	})
+	h.Write(ad)
+	return h.Sum(nil)
+}
 
-	return
+// headerLen returns the maximum length of a header for n X25519
+// recipients, without any optional fields.
+func headerLen(version, suite byte, n int) int {
+	size := slotLen(version)
+	if version >= version5 {
+		size = stanzaHeaderLen + x25519SlotLen
+	}
+	return prefixLen +
+		nonceLen(suite) +
+		len(PublicKey{}) +
+		maxRecipientCountLen16 +
+		(n * size)
 }
 
 func writeRecipientCount(out []byte, x uint16) int {
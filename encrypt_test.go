@@ -0,0 +1,343 @@
+package alex
+
+import (
+	"bytes"
+	"crypto/rand"
+	"testing"
+)
+
+func generateKeys(t *testing.T) (*PrivateKey, *PublicKey) {
+	privateKey, err := GeneratePrivateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	publicKey := privateKey.PublicKey()
+	return &privateKey, &publicKey
+}
+
+func TestEncryptAndDecrypt(t *testing.T) {
+	sender, _ := generateKeys(t)
+	recipient, recipientPublicKey := generateKeys(t)
+	msg := []byte("Hello World")
+
+	enc, err := Encrypt(msg, sender, recipientPublicKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.HasPrefix(enc, magic[:]) {
+		t.Fatalf("Expected envelope to start with %q", magic)
+	}
+
+	dec, err := Decrypt(enc, recipient)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(dec, msg) {
+		t.Errorf("Expected to be equal\n'%s'\n'%s'", dec, msg)
+	}
+}
+
+func TestDecryptUnsupportedPrefix(t *testing.T) {
+	sender, _ := generateKeys(t)
+	recipient, recipientPublicKey := generateKeys(t)
+
+	for _, tc := range []struct {
+		offset int
+		value  byte
+		err    error
+	}{
+		{len(magic), 0xff, ErrUnsupportedVersion},
+		{len(magic) + 1, 0xff, ErrUnsupportedSuite},
+		{len(magic) + 2, 0xff, ErrUnsupportedFlags},
+	} {
+		enc, err := Encrypt([]byte("Hello World"), sender, recipientPublicKey)
+		if err != nil {
+			t.Fatal(err)
+		}
+		enc[tc.offset] = tc.value
+		if _, err := Decrypt(enc, recipient); err != tc.err {
+			t.Errorf("Expected %s but got %v", tc.err, err)
+		}
+	}
+}
+
+func TestEncryptAnonymous(t *testing.T) {
+	recipient, recipientPublicKey := generateKeys(t)
+	msg := []byte("Hello World")
+
+	enc1, err := EncryptAnonymous(msg, recipientPublicKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	enc2, err := EncryptAnonymous(msg, recipientPublicKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	h1, err := readHeader(bytes.NewReader(enc1))
+	if err != nil {
+		t.Fatal(err)
+	}
+	h2, err := readHeader(bytes.NewReader(enc2))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if h1.sender == h2.sender {
+		t.Error("Expected a fresh sender key for each message")
+	}
+	if h1.sender == *recipientPublicKey {
+		t.Error("Expected sender key to not be the recipient key")
+	}
+
+	dec, err := Decrypt(enc1, recipient)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(dec, msg) {
+		t.Errorf("Expected to be equal\n'%s'\n'%s'", dec, msg)
+	}
+}
+
+func TestEncryptPadRecipients(t *testing.T) {
+	sender, _ := generateKeys(t)
+	var recipients []*PrivateKey
+	var peers []*PublicKey
+	for i := 0; i < 3; i++ {
+		recipient, recipientPublicKey := generateKeys(t)
+		recipients = append(recipients, recipient)
+		peers = append(peers, recipientPublicKey)
+	}
+	msg := []byte("Hello World")
+
+	for _, opts := range []*EncryptOptions{
+		{PadRecipients: true},
+		{PadRecipients: true, Authenticate: true},
+	} {
+		enc, err := EncryptWithOptions(msg, sender, opts, peers...)
+		if err != nil {
+			t.Fatal(err)
+		}
+		h, err := readHeader(bytes.NewReader(enc))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(h.slots) != 4 {
+			t.Errorf("Expected 4 slots but got %d", len(h.slots))
+		}
+
+		for _, recipient := range recipients {
+			dec, err := Decrypt(enc, recipient)
+			if err != nil {
+				t.Fatalf("Unexpected decrypt error: %s", err)
+			}
+			if !bytes.Equal(dec, msg) {
+				t.Errorf("Expected to be equal\n'%s'\n'%s'", dec, msg)
+			}
+		}
+	}
+}
+
+func TestPadRecipients(t *testing.T) {
+	for _, tc := range []struct{ n, padded int }{
+		{1, 1}, {2, 2}, {3, 4}, {5, 8}, {1000, 1024}, {40000, 65535},
+	} {
+		shared, err := padRecipients(rand.Reader, make([]Recipient, tc.n))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(shared) != tc.padded {
+			t.Errorf("Expected %d slots for %d recipients but got %d", tc.padded, tc.n, len(shared))
+		}
+	}
+}
+
+func TestEncryptSuites(t *testing.T) {
+	sender, _ := generateKeys(t)
+	recipient, recipientPublicKey := generateKeys(t)
+	_, otherPublicKey := generateKeys(t)
+	signingKey, _ := GenerateSigningKey(rand.Reader)
+	msg := make([]byte, chunkSize+1)
+
+	for _, tc := range []struct {
+		suite    Suite
+		nonceLen int
+	}{
+		{0, 16},
+		{SuiteAES256GCM, 16},
+		{SuiteXChaCha20Poly1305, 24},
+	} {
+		opts := &EncryptOptions{Suite: tc.suite, SigningKey: &signingKey, Authenticate: true}
+		enc, err := EncryptWithOptions(msg, sender, opts, otherPublicKey, recipientPublicKey)
+		if err != nil {
+			t.Fatal(err)
+		}
+		h, err := readHeader(bytes.NewReader(enc))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if h.suite != opts.suite() || len(h.nonce) != tc.nonceLen {
+			t.Errorf("Expected suite %d with a %d byte nonce but got %d with %d", opts.suite(), tc.nonceLen, h.suite, len(h.nonce))
+		}
+
+		dec, _, err := DecryptAuthenticated(enc, recipient)
+		if err != nil {
+			t.Fatalf("Unexpected decrypt error: %s", err)
+		}
+		if !bytes.Equal(dec, msg) {
+			t.Error("Decrypted message not equal")
+		}
+	}
+
+	if _, err := EncryptWithOptions(msg, sender, &EncryptOptions{Suite: 0xff}, recipientPublicKey); err != ErrUnsupportedSuite {
+		t.Errorf("Expected %s but got %v", ErrUnsupportedSuite, err)
+	}
+}
+
+func TestEncryptAssociatedData(t *testing.T) {
+	sender, _ := generateKeys(t)
+	recipient, recipientPublicKey := generateKeys(t)
+	signingKey, _ := GenerateSigningKey(rand.Reader)
+	msg := []byte("Hello World")
+
+	enc, err := EncryptWithOptions(msg, sender, &EncryptOptions{AD: []byte("row 1"), SigningKey: &signingKey}, recipientPublicKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	dec, err := DecryptWithOptions(enc, recipient, &DecryptOptions{AD: []byte("row 1")})
+	if err != nil {
+		t.Fatalf("Unexpected decrypt error: %s", err)
+	}
+	if !bytes.Equal(dec, msg) {
+		t.Errorf("Expected to be equal\n'%s'\n'%s'", dec, msg)
+	}
+
+	for _, ad := range [][]byte{nil, []byte("row 2")} {
+		if _, err := DecryptWithOptions(enc, recipient, &DecryptOptions{AD: ad}); err != ErrFailedToDecrypt {
+			t.Errorf("%q: Expected %s but got %v", ad, ErrFailedToDecrypt, err)
+		}
+	}
+
+	plain, err := Encrypt(msg, sender, recipientPublicKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := DecryptWithOptions(plain, recipient, &DecryptOptions{AD: []byte("row 1")}); err != ErrFailedToDecrypt {
+		t.Errorf("Expected %s but got %v", ErrFailedToDecrypt, err)
+	}
+}
+
+func TestEncryptPad(t *testing.T) {
+	sender, _ := generateKeys(t)
+	recipient, recipientPublicKey := generateKeys(t)
+	signingKey, _ := GenerateSigningKey(rand.Reader)
+
+	lens := map[int]int{}
+	for _, n := range []int{0, 2, 3, 255, 256, 257, chunkSize - 1, chunkSize, 3*chunkSize + 5} {
+		msg := make([]byte, n)
+		rand.Read(msg)
+		enc, err := EncryptWithOptions(msg, sender, &EncryptOptions{Pad: true, SigningKey: &signingKey}, recipientPublicKey)
+		if err != nil {
+			t.Fatal(err)
+		}
+		dec, err := Decrypt(enc, recipient)
+		if err != nil {
+			t.Fatalf("%d: Unexpected decrypt error: %s", n, err)
+		}
+		if !bytes.Equal(dec, msg) {
+			t.Errorf("%d: Decrypted message not equal", n)
+		}
+		lens[n] = len(enc)
+	}
+	if lens[0] != lens[3] || lens[3] != lens[256] {
+		t.Errorf("Expected short messages to be padded to the same length, got %d, %d and %d", lens[0], lens[3], lens[256])
+	}
+	if lens[257] == lens[256] {
+		t.Error("Expected longer messages to be padded further")
+	}
+}
+
+func TestPaddedLen(t *testing.T) {
+	for _, tc := range []struct{ n, padded int64 }{
+		{0, 256}, {255, 256}, {256, 256}, {257, 272}, {1000, 1024}, {1 << 20, 1 << 20}, {1<<20 + 1, 1<<20 + 1<<15},
+	} {
+		if padded := paddedLen(tc.n); padded != tc.padded {
+			t.Errorf("Expected %d to be padded to %d but got %d", tc.n, tc.padded, padded)
+		}
+	}
+}
+
+func TestUnpad(t *testing.T) {
+	for _, tc := range []struct {
+		chunk, msg []byte
+		err        error
+	}{
+		{[]byte{padMarker}, []byte{}, nil},
+		{[]byte{1, padMarker, 0, 0}, []byte{1}, nil},
+		{[]byte{padMarker, padMarker}, []byte{padMarker}, nil},
+		{[]byte{}, nil, ErrBadPadding},
+		{[]byte{0, 0}, nil, ErrBadPadding},
+		{[]byte{padMarker, 1}, nil, ErrBadPadding},
+	} {
+		msg, err := unpad(tc.chunk)
+		if err != tc.err || !bytes.Equal(msg, tc.msg) {
+			t.Errorf("%x: Expected %x, %v but got %x, %v", tc.chunk, tc.msg, tc.err, msg, err)
+		}
+	}
+}
+
+func TestEncryptCompress(t *testing.T) {
+	sender, _ := generateKeys(t)
+	recipient, recipientPublicKey := generateKeys(t)
+	msg := bytes.Repeat([]byte(`{"level":"info","msg":"request served"}`+"\n"), 5000)
+
+	plain, err := Encrypt(msg, sender, recipientPublicKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, opts := range []*EncryptOptions{
+		{Compress: true},
+		{Compress: true, Pad: true, Authenticate: true},
+	} {
+		enc, err := EncryptWithOptions(msg, sender, opts, recipientPublicKey)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(enc) >= len(plain)/10 {
+			t.Errorf("Expected the envelope to be compressed, got %d bytes of %d", len(enc), len(plain))
+		}
+		dec, err := Decrypt(enc, recipient)
+		if err != nil {
+			t.Fatalf("Unexpected decrypt error: %s", err)
+		}
+		if !bytes.Equal(dec, msg) {
+			t.Error("Decrypted message not equal")
+		}
+
+		r, err := NewDecryptReader(bytes.NewReader(enc), recipient)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var buf bytes.Buffer
+		if _, err := buf.ReadFrom(r); err != nil {
+			t.Fatalf("Unexpected read error: %s", err)
+		}
+		if !bytes.Equal(buf.Bytes(), msg) {
+			t.Error("Decrypted stream not equal")
+		}
+	}
+
+	// plaintext after the end of the compressed stream
+	var enc bytes.Buffer
+	w, err := NewEncryptWriterWithOptions(&enc, sender, &EncryptOptions{Compress: true}, recipientPublicKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	c := w.(*compressWriter)
+	c.Write(msg)
+	c.Writer.Close()
+	c.e.Write([]byte("trailing"))
+	c.e.Close()
+	if _, err := Decrypt(enc.Bytes(), recipient); err != ErrTrailingData {
+		t.Errorf("Expected %s but got %v", ErrTrailingData, err)
+	}
+}
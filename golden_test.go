@@ -0,0 +1,96 @@
+package alex
+
+import (
+	"bytes"
+	"crypto/cipher"
+	"flag"
+	"io"
+	"io/ioutil"
+	"path/filepath"
+	"testing"
+
+	"desource.net/alex/pkg/chacha20"
+)
+
+var update = flag.Bool("update", false, "update the golden test vectors in testdata/golden")
+
+type zeroReader struct{}
+
+func (zeroReader) Read(p []byte) (int, error) {
+	for i := range p {
+		p[i] = 0
+	}
+	return len(p), nil
+}
+
+// testRand returns a reproducible source of randomness for the seed.
+func testRand(seed byte) io.Reader {
+	key := make([]byte, chacha20.KeySize)
+	key[0] = seed
+	c, _ := chacha20.NewUnauthenticatedCipher(key, make([]byte, chacha20.NonceSize))
+	return cipher.StreamReader{S: c, R: zeroReader{}}
+}
+
+func TestGoldenVectors(t *testing.T) {
+	privateKey, publicKey := exampleKeys(t)
+	otherKey, _ := GeneratePrivateKey(testRand(0xff))
+	otherPublicKey := otherKey.PublicKey()
+	signingKey, _ := GenerateSigningKey(testRand(0xfe))
+	msg := []byte(exampleMsg)
+
+	for _, tc := range []struct {
+		name       string
+		privateKey *PrivateKey
+		opts       EncryptOptions
+	}{
+		{"default", privateKey, EncryptOptions{}},
+		{"anonymous", nil, EncryptOptions{}},
+		{"signed", privateKey, EncryptOptions{SigningKey: &signingKey}},
+		{"authenticated", privateKey, EncryptOptions{Authenticate: true}},
+		{"padded", privateKey, EncryptOptions{PadRecipients: true, Authenticate: true}},
+		{"chacha", privateKey, EncryptOptions{Suite: SuiteXChaCha20Poly1305}},
+		{"ad", privateKey, EncryptOptions{AD: []byte("users/42")}},
+		{"pad", privateKey, EncryptOptions{Pad: true}},
+		{"compress", privateKey, EncryptOptions{Compress: true}},
+	} {
+		tc.opts.Rand = testRand(1)
+		enc, err := EncryptWithOptions(msg, tc.privateKey, &tc.opts, publicKey, &otherPublicKey, &otherPublicKey)
+		if err != nil {
+			t.Fatalf("%s: %s", tc.name, err)
+		}
+
+		golden := filepath.Join("testdata", "golden", tc.name)
+		if *update {
+			if err := ioutil.WriteFile(golden, enc, 0644); err != nil {
+				t.Fatal(err)
+			}
+		}
+		expected, err := ioutil.ReadFile(golden)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if tc.opts.Compress {
+			// DEFLATE output may change across Go releases, the header
+			// may not
+			h, err := ParseHeader(bytes.NewReader(expected))
+			if err != nil {
+				t.Fatalf("%s: %s", tc.name, err)
+			}
+			if !bytes.HasPrefix(enc, expected[:h.PayloadOffset]) {
+				t.Errorf("%s: Header differs from %s", tc.name, golden)
+			}
+		} else if !bytes.Equal(enc, expected) {
+			t.Errorf("%s: Envelope differs from %s", tc.name, golden)
+		}
+
+		for _, enc := range [][]byte{expected, enc} {
+			dec, err := DecryptWithOptions(enc, privateKey, &DecryptOptions{AD: tc.opts.AD})
+			if err != nil {
+				t.Fatalf("%s: Unexpected decrypt error: %s", tc.name, err)
+			}
+			if !bytes.Equal(dec, msg) {
+				t.Errorf("%s: Decrypted message not equal", tc.name)
+			}
+		}
+	}
+}
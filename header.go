@@ -0,0 +1,351 @@
+package alex
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"encoding/binary"
+	"fmt"
+	"io"
+
+	"desource.net/alex/pkg/chacha20poly1305"
+)
+
+// Every envelope starts with a fixed prefix which identifies the format:
+//
+//	magic (4) | version (1) | suite (1) | flags (1)
+//
+// Envelopes written before the prefix was introduced start directly with
+// the nonce, they are treated as version 0 and can still be decrypted.
+var magic = [4]byte{'a', 'l', 'e', 'x'}
+
+const prefixLen = len(magic) + 3
+
+// Format versions
+const (
+	version0 byte = iota // legacy, no prefix
+	version1
+	version2 // chunked payload
+	version3 // key confirmation tag in each slot
+	version4 // slots sealed with a derived key
+	version5 // typed recipient stanzas
+)
+
+// Header flags
+const (
+	flagSigned        byte = 1 << iota // see sign.go
+	flagAuthenticated                  // see auth.go
+	flagPadded                         // see pad.go
+	flagCompressed                     // see compress.go
+	flagMetadata                       // see metadata.go
+	flagArchive                        // see archive.go
+
+	knownFlags = flagSigned | flagAuthenticated | payloadFlags
+
+	// payloadFlags only change how the plaintext is encoded
+	payloadFlags = flagPadded | flagCompressed | flagMetadata | flagArchive
+)
+
+// Cipher suites
+const (
+	suiteX25519AES256GCM byte = 1 + iota
+	suiteX25519XChaCha20Poly1305
+)
+
+// Suite is the cipher which seals the payload and recipient slots of an
+// envelope, it is recorded in the header.
+type Suite byte
+
+const (
+	// SuiteAES256GCM is AES-256-GCM with a 16 byte header nonce, the
+	// default.
+	SuiteAES256GCM = Suite(suiteX25519AES256GCM)
+
+	// SuiteXChaCha20Poly1305 is XChaCha20-Poly1305 with a 24 byte header
+	// nonce, which is constant-time without AES hardware.
+	SuiteXChaCha20Poly1305 = Suite(suiteX25519XChaCha20Poly1305)
+)
+
+func (s Suite) String() string {
+	switch s {
+	case SuiteAES256GCM:
+		return "X25519-AES256GCM"
+	case SuiteXChaCha20Poly1305:
+		return "X25519-XChaCha20Poly1305"
+	}
+	return fmt.Sprintf("unknown (%d)", byte(s))
+}
+
+// nonceLen returns the length of the header nonce of a suite.
+func nonceLen(suite byte) int {
+	if suite == suiteX25519XChaCha20Poly1305 {
+		return chacha20poly1305.NonceSizeX
+	}
+	return aes.BlockSize
+}
+
+// newAEAD returns the AEAD of a suite for the key.
+func newAEAD(suite byte, key *sessionKey) (cipher.AEAD, error) {
+	if suite == suiteX25519XChaCha20Poly1305 {
+		return chacha20poly1305.NewX(key[:])
+	}
+	sessionAes, err := aes.NewCipher(key[:])
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(sessionAes)
+}
+
+func writePrefix(out []byte, version, suite, flags byte) int {
+	copy(out, magic[:])
+	out[len(magic)] = version
+	out[len(magic)+1] = suite
+	out[len(magic)+2] = flags
+	return prefixLen
+}
+
+// readPrefix returns the version, suite and flags of the envelope in data,
+// and the number of bytes read.
+func readPrefix(data []byte) (version, suite, flags byte, n int, err error) {
+	if !bytes.HasPrefix(data, magic[:]) {
+		return version0, suiteX25519AES256GCM, 0, 0, nil
+	}
+	if len(data) < prefixLen {
+		return 0, 0, 0, 0, ErrTruncated
+	}
+	version = data[len(magic)]
+	suite = data[len(magic)+1]
+	flags = data[len(magic)+2]
+	switch {
+	case version < version1 || version > version5:
+		err = ErrUnsupportedVersion
+	case suite != suiteX25519AES256GCM && suite != suiteX25519XChaCha20Poly1305,
+		version < version4 && suite != suiteX25519AES256GCM:
+		err = ErrUnsupportedSuite
+	case flags&^knownFlags != 0,
+		version < version2 && flags != 0,
+		// payload flags were added in version 5, before which the
+		// flags are not bound to the slots and can be tampered with
+		version < version5 && flags&payloadFlags != 0:
+		err = ErrUnsupportedFlags
+	}
+	return version, suite, flags, prefixLen, err
+}
+
+// header is the parsed header of an envelope.
+type header struct {
+	version byte
+	suite   byte
+	flags   byte
+	nonce   []byte // see nonceLen
+	sender  PublicKey
+	slots   [][]byte // wrapped session keys, see slotLen
+	types   []byte   // stanza type of each slot
+
+	sealedSigner []byte // with flagSigned
+
+	raw      []byte // header as read
+	countLen int    // of the recipient count
+}
+
+// A slot holds the wrapped session key. From version 4 the key is sealed
+// with a key derived for the recipient, see wrapSessionKey, so a tampered
+// slot fails on its own. Version 3 has the key encrypted with AES-CTR and
+// followed by a tag which confirms it, see legacy.go.
+//
+// From version 5 each slot is a stanza of a type, which says how to unwrap
+// it, and a length prefixed body:
+//
+//	type (1) | length (2) | body
+//
+// The body holds any arguments of the type followed by the wrapped key.
+// The body of an X25519 stanza is a version 4 slot. Before version 5 every
+// slot is X25519 and has a fixed length, see slotLen.
+const (
+	slotTagLen      = 16
+	x25519SlotLen   = sessionKeyLen + slotTagLen
+	stanzaHeaderLen = 3
+)
+
+// slotLen returns the length of a recipient slot before version 5.
+func slotLen(version byte) int {
+	if version < version3 {
+		return sessionKeyLen
+	}
+	return x25519SlotLen
+}
+
+// appendSlot appends a slot in the format of the version to out.
+func appendSlot(out []byte, version, stanzaType byte, body []byte) []byte {
+	if version >= version5 {
+		out = append(out, stanzaType, byte(len(body)>>8), byte(len(body)))
+	}
+	return append(out, body...)
+}
+
+// slotAD returns the header fields every slot is bound to, everything
+// before the recipient count.
+func (h *header) slotAD() []byte {
+	return h.raw[:prefixLen+len(h.nonce)+len(h.sender)]
+}
+
+// readHeader reads the header of an envelope from r, leaving r at the
+// start of the payload. It only reads as much as the header declares, and
+// fails with ErrTruncated if r ends early. On error it also returns what
+// was parsed before it, for debugging.
+func readHeader(r io.Reader) (*header, error) {
+	src := &readSource{r: r, raw: make([]byte, 0, headerLen(version5, suiteX25519XChaCha20Poly1305, 1))}
+	h, err := parseHeader(src)
+	h.raw = src.raw
+	return h, err
+}
+
+// sliceHeader parses the header at the start of data as readHeader does.
+// Its fields are slices of data, which is not copied.
+func sliceHeader(data []byte) (*header, error) {
+	src := &sliceSource{data: data}
+	h, err := parseHeader(src)
+	h.raw = data[:src.off]
+	return h, err
+}
+
+// headerSource hands out the fields of a header in order. next returns the
+// next n bytes, which the header keeps, or ErrTruncated.
+type headerSource interface {
+	next(n int) ([]byte, error)
+}
+
+// readSource reads the fields from r and keeps the header as read in raw.
+// The fields are slices of raw, which is only appended to.
+type readSource struct {
+	r   io.Reader
+	raw []byte
+}
+
+func (s *readSource) next(n int) ([]byte, error) {
+	l := len(s.raw)
+	s.raw = append(s.raw, make([]byte, n)...)
+	m, err := io.ReadFull(s.r, s.raw[l:])
+	s.raw = s.raw[:l+m]
+	if err != nil {
+		return nil, truncated(err)
+	}
+	return s.raw[l : l+n : l+n], nil
+}
+
+// sliceSource hands out the fields of a header at the start of data.
+type sliceSource struct {
+	data []byte
+	off  int
+}
+
+func (s *sliceSource) next(n int) ([]byte, error) {
+	if n > len(s.data)-s.off {
+		s.off = len(s.data)
+		return nil, ErrTruncated
+	}
+	b := s.data[s.off : s.off+n : s.off+n]
+	s.off += n
+	return b, nil
+}
+
+// parseHeader parses a header from the fields of src.
+func parseHeader(src headerSource) (*header, error) {
+	h := new(header)
+	start, err := src.next(len(magic))
+	if err != nil {
+		return h, err
+	}
+	if bytes.Equal(start, magic[:]) {
+		rest, err := src.next(prefixLen - len(magic))
+		if err != nil {
+			return h, err
+		}
+		var prefix [prefixLen]byte
+		copy(prefix[copy(prefix[:], start):], rest)
+		h.version, h.suite, h.flags, _, err = readPrefix(prefix[:])
+		if err != nil {
+			return h, err
+		}
+		if h.nonce, err = src.next(nonceLen(h.suite)); err != nil {
+			return h, err
+		}
+	} else {
+		// version 0 starts with the nonce
+		h.version, h.suite = version0, suiteX25519AES256GCM
+		rest, err := src.next(nonceLen(h.suite) - len(magic))
+		if err != nil {
+			return h, err
+		}
+		h.nonce = append(start, rest...)
+	}
+
+	sender, err := src.next(len(h.sender))
+	if err != nil {
+		return h, err
+	}
+	copy(h.sender[:], sender)
+
+	var count [maxRecipientCountLen16]byte
+	n := 0
+	for n < len(count) {
+		b, err := src.next(1)
+		if err != nil {
+			return h, err
+		}
+		count[n] = b[0]
+		n++
+		if b[0] < 0x80 {
+			break
+		}
+	}
+	recipients, _, err := readRecipientCount(count[:n])
+	if err != nil {
+		return h, err
+	}
+	h.countLen = n
+
+	if h.version >= version5 {
+		h.types = make([]byte, 0, recipients)
+		h.slots = make([][]byte, 0, recipients)
+		for i := 0; i < int(recipients); i++ {
+			stanza, err := src.next(stanzaHeaderLen)
+			if err != nil {
+				return h, err
+			}
+			body, err := src.next(int(binary.BigEndian.Uint16(stanza[1:])))
+			if err != nil {
+				return h, err
+			}
+			h.types = append(h.types, stanza[0])
+			h.slots = append(h.slots, body)
+		}
+	} else {
+		l := slotLen(h.version)
+		slots, err := src.next(int(recipients) * l)
+		if err != nil {
+			return h, err
+		}
+		for len(slots) > 0 {
+			h.types = append(h.types, StanzaX25519)
+			h.slots = append(h.slots, slots[:l:l])
+			slots = slots[l:]
+		}
+	}
+
+	if h.flags&flagSigned != 0 {
+		if h.sealedSigner, err = src.next(sealedVerifyKeyLen); err != nil {
+			return h, err
+		}
+	}
+
+	return h, nil
+}
+
+// truncated maps an unexpected end of input to ErrTruncated.
+func truncated(err error) error {
+	if err == io.EOF || err == io.ErrUnexpectedEOF {
+		return ErrTruncated
+	}
+	return err
+}
@@ -0,0 +1,83 @@
+package alex
+
+// Stanza types say how the session key in a slot is wrapped. Types from
+// 128 are left to applications.
+const (
+	StanzaX25519 byte = 1 + iota
+)
+
+// Slot is a recipient slot of an envelope, with the header fields the
+// wrapped session key is bound to.
+type Slot struct {
+	Suite  Suite
+	Nonce  []byte    // header nonce
+	Sender PublicKey // may be ephemeral
+	AD     []byte    // header fields before the recipient count
+	Body   []byte    // wrapped session key
+}
+
+// Recipient wraps the session key of an envelope for one recipient.
+type Recipient interface {
+	// StanzaType is the type of the slots of the recipient.
+	StanzaType() byte
+
+	// Wrap returns the body of the slot, any arguments followed by the
+	// session key wrapped for the recipient.
+	Wrap(slot *Slot, sessionKey []byte) ([]byte, error)
+}
+
+// Identity unwraps the session key from the slots meant for it, so the
+// private key can be kept outside of the process, such as in an agent.
+type Identity interface {
+	// StanzaType is the type of the slots the identity can unwrap, it is
+	// only given slots of this type.
+	StanzaType() byte
+
+	// Unwrap returns the session key in the slot, or ErrFailedToDecrypt if
+	// the slot is not for this identity.
+	Unwrap(slot *Slot) ([]byte, error)
+}
+
+func (k *PrivateKey) StanzaType() byte { return StanzaX25519 }
+
+// Unwrap returns the session key in an X25519 slot.
+func (k *PrivateKey) Unwrap(slot *Slot) ([]byte, error) {
+	x := x25519Identity{k.sharedKey(&slot.Sender)}
+	return x.Unwrap(slot)
+}
+
+// x25519Recipient wraps the session key with the key the sender shares
+// with the recipient, see wrapSessionKey.
+type x25519Recipient struct {
+	shared sharedKey
+}
+
+func (x *x25519Recipient) StanzaType() byte { return StanzaX25519 }
+
+func (x *x25519Recipient) Wrap(slot *Slot, key []byte) ([]byte, error) {
+	body := make([]byte, x25519SlotLen)
+	if err := wrapSessionKey(byte(slot.Suite), body, &x.shared, slot.Nonce, slot.AD, key); err != nil {
+		return nil, err
+	}
+	return body, nil
+}
+
+// x25519Identity unwraps with a shared key computed once for all of the
+// slots of an envelope.
+type x25519Identity struct {
+	shared sharedKey
+}
+
+func (x *x25519Identity) StanzaType() byte { return StanzaX25519 }
+
+func (x *x25519Identity) Unwrap(slot *Slot) ([]byte, error) {
+	aead, err := newAEAD(byte(slot.Suite), wrapKey(&x.shared, slot.Nonce))
+	if err != nil {
+		return nil, err
+	}
+	key, err := aead.Open(nil, wrapNonce[:aead.NonceSize()], slot.Body, slot.AD)
+	if err != nil {
+		return nil, ErrFailedToDecrypt
+	}
+	return key, nil
+}
@@ -0,0 +1,120 @@
+package alex
+
+import (
+	"bytes"
+	"testing"
+)
+
+// agentIdentity keeps the private key to itself, as an agent would.
+type agentIdentity struct {
+	privateKey *PrivateKey
+}
+
+func (a *agentIdentity) StanzaType() byte { return StanzaX25519 }
+
+func (a *agentIdentity) Unwrap(slot *Slot) ([]byte, error) {
+	return a.privateKey.Unwrap(slot)
+}
+
+// pskRecipient wraps the session key with a pre-shared key.
+type pskRecipient struct {
+	psk sharedKey
+}
+
+// stanzaPSK is the stanza type of pskRecipient
+const stanzaPSK = 0x80
+
+func (p *pskRecipient) StanzaType() byte { return stanzaPSK }
+
+func (p *pskRecipient) Wrap(slot *Slot, key []byte) ([]byte, error) {
+	aead, err := newAEAD(byte(slot.Suite), wrapKey(&p.psk, slot.Nonce))
+	if err != nil {
+		return nil, err
+	}
+	return aead.Seal(nil, make([]byte, aead.NonceSize()), key, slot.AD), nil
+}
+
+func (p *pskRecipient) Unwrap(slot *Slot) ([]byte, error) {
+	return (&x25519Identity{p.psk}).Unwrap(slot)
+}
+
+// countingIdentity counts the slots it is given.
+type countingIdentity struct {
+	Identity
+	n int
+}
+
+func (c *countingIdentity) Unwrap(slot *Slot) ([]byte, error) {
+	c.n++
+	return c.Identity.Unwrap(slot)
+}
+
+type badRecipient struct{}
+
+func (badRecipient) StanzaType() byte { return stanzaPSK }
+
+func (badRecipient) Wrap(slot *Slot, key []byte) ([]byte, error) {
+	return make([]byte, 1<<16), nil
+}
+
+func TestDecryptWithIdentity(t *testing.T) {
+	sender, senderPublicKey := generateKeys(t)
+	recipient, recipientPublicKey := generateKeys(t)
+	agent := &agentIdentity{recipient}
+	msg := make([]byte, chunkSize+1)
+
+	enc, err := EncryptWithOptions(msg, sender, &EncryptOptions{Authenticate: true}, recipientPublicKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	dec, err := DecryptWithIdentity(enc, agent, nil)
+	if err != nil {
+		t.Fatalf("Unexpected decrypt error: %s", err)
+	}
+	if !bytes.Equal(dec, msg) {
+		t.Error("Decrypted message not equal")
+	}
+
+	// only the private key itself can verify the sender
+	if _, err := DecryptWithIdentity(enc, agent, &DecryptOptions{Sender: senderPublicKey}); err != ErrNotAuthenticated {
+		t.Errorf("Expected %s but got %v", ErrNotAuthenticated, err)
+	}
+	if _, err := DecryptWithIdentity(enc, recipient, &DecryptOptions{Sender: senderPublicKey}); err != nil {
+		t.Errorf("Unexpected decrypt error: %s", err)
+	}
+}
+
+func TestEncryptToRecipients(t *testing.T) {
+	sender, _ := generateKeys(t)
+	recipient, recipientPublicKey := generateKeys(t)
+	psk := &pskRecipient{}
+	copy(psk.psk[:], "a pre-shared key of 32 bytes....")
+	msg := []byte("Hello World")
+
+	for _, opts := range []*EncryptOptions{
+		{Recipients: []Recipient{psk}},
+		{Recipients: []Recipient{psk}, PadRecipients: true, Suite: SuiteXChaCha20Poly1305},
+	} {
+		enc, err := EncryptWithOptions(msg, sender, opts, recipientPublicKey)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, identity := range []Identity{recipient, psk} {
+			counting := &countingIdentity{Identity: identity}
+			dec, err := DecryptWithIdentity(enc, counting, nil)
+			if err != nil {
+				t.Fatalf("Unexpected decrypt error: %s", err)
+			}
+			if !bytes.Equal(dec, msg) {
+				t.Errorf("Expected to be equal\n'%s'\n'%s'", dec, msg)
+			}
+			if identity == psk && counting.n != 1 {
+				t.Errorf("Expected only the stanza of the identity to be tried, got %d", counting.n)
+			}
+		}
+	}
+
+	if _, err := EncryptWithOptions(msg, sender, &EncryptOptions{Recipients: []Recipient{badRecipient{}}}); err != ErrSlotSize {
+		t.Errorf("Expected %s but got %v", ErrSlotSize, err)
+	}
+}
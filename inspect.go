@@ -0,0 +1,103 @@
+package alex
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+)
+
+// Header is the part of an envelope which can be read without a private
+// key.
+type Header struct {
+	Version byte
+	Suite   Suite
+	Sender  PublicKey // ephemeral if sent anonymously
+
+	// Recipients is the number of slots, including any padding.
+	Recipients int
+
+	Signed        bool
+	Authenticated bool
+	Padded        bool
+	Compressed    bool
+	HasMetadata   bool
+	Archive       bool
+
+	// PayloadOffset is the length of the header, the payload starts right
+	// after it.
+	PayloadOffset int64
+
+	// Fields lays out the header, for debugging.
+	Fields []HeaderField
+}
+
+// HeaderField is a field of the header, at Offset from the start of the
+// envelope.
+type HeaderField struct {
+	Name   string
+	Offset int
+	Len    int
+}
+
+// ParseHeader reads the header of an envelope from r, leaving r at the
+// start of the payload. It parses the header the same way Decrypt does.
+//
+// If the header is malformed it returns the error along with what was
+// parsed before it: the Fields then cover the bytes read up to the field
+// which failed, and PayloadOffset is the number of bytes read.
+func ParseHeader(r io.Reader) (*Header, error) {
+	h, err := readHeader(r)
+	return &Header{
+		Version:       h.version,
+		Suite:         Suite(h.suite),
+		Sender:        h.sender,
+		Recipients:    len(h.slots),
+		Signed:        h.flags&flagSigned != 0,
+		Authenticated: h.flags&flagAuthenticated != 0,
+		Padded:        h.flags&flagPadded != 0,
+		Compressed:    h.flags&flagCompressed != 0,
+		HasMetadata:   h.flags&flagMetadata != 0,
+		Archive:       h.flags&flagArchive != 0,
+		PayloadOffset: int64(len(h.raw)),
+		Fields:        h.fields(),
+	}, err
+}
+
+// fields returns the layout of the header, up to the bytes read of a
+// header which failed to parse.
+func (h *header) fields() (fields []HeaderField) {
+	if len(h.raw) < len(magic) {
+		// too short to tell the version
+		return nil
+	}
+	offset := 0
+	add := func(name string, l int) {
+		if rest := len(h.raw) - offset; l > rest {
+			l = rest
+		}
+		if l > 0 {
+			fields = append(fields, HeaderField{name, offset, l})
+			offset += l
+		}
+	}
+	if bytes.HasPrefix(h.raw, magic[:]) {
+		add("magic", len(magic))
+		add("version", 1)
+		add("suite", 1)
+		add("flags", 1)
+	}
+	add("nonce", len(h.nonce))
+	add("sender", len(h.sender))
+	add("recipients", h.countLen)
+	for r, body := range h.slots {
+		if h.version >= version5 {
+			add(fmt.Sprintf("slot %d type %d", r+1, h.types[r]), stanzaHeaderLen+len(body))
+		} else {
+			add(fmt.Sprintf("slot %d", r+1), len(body))
+		}
+	}
+	if h.sealedSigner != nil {
+		add("sealed verify key", len(h.sealedSigner))
+	}
+	return fields
+}
@@ -0,0 +1,53 @@
+package alex
+
+import (
+	"bytes"
+	"testing"
+)
+
+func TestParseHeaderMalformed(t *testing.T) {
+	sender, _ := generateKeys(t)
+	_, recipientPublicKey := generateKeys(t)
+
+	enc, err := Encrypt([]byte("Hello World"), sender, recipientPublicKey, recipientPublicKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	h, err := ParseHeader(bytes.NewReader(enc))
+	if err != nil {
+		t.Fatal(err)
+	}
+	header := int(h.PayloadOffset)
+	if last := h.Fields[len(h.Fields)-1]; last.Offset+last.Len != header {
+		t.Errorf("Expected the fields to cover the header of %d bytes but got %+v", header, last)
+	}
+
+	// the fields end where the header is cut
+	for _, l := range []int{len(magic), 20, header - 1} {
+		h, err := ParseHeader(bytes.NewReader(enc[:l]))
+		if err != ErrTruncated {
+			t.Fatalf("%d: Expected %s but got %v", l, ErrTruncated, err)
+		}
+		if h.PayloadOffset != int64(l) {
+			t.Errorf("%d: Expected %d bytes read but got %d", l, l, h.PayloadOffset)
+		}
+		end := 0
+		for _, f := range h.Fields {
+			if f.Offset != end {
+				t.Errorf("%d: Expected %s at %d but got %d", l, f.Name, end, f.Offset)
+			}
+			end += f.Len
+		}
+		if end > l || h.Fields[0].Name != "magic" {
+			t.Errorf("%d: Unexpected fields %+v", l, h.Fields)
+		}
+	}
+
+	// the prefix is parsed before an unsupported version
+	bad := append([]byte{}, enc...)
+	bad[len(magic)] = 0xff
+	h, err = ParseHeader(bytes.NewReader(bad))
+	if err != ErrUnsupportedVersion || len(h.Fields) != 4 || h.Version != 0xff {
+		t.Errorf("Expected the prefix fields and %s but got %+v, %v", ErrUnsupportedVersion, h, err)
+	}
+}
@@ -1,6 +1,7 @@
 package alex
 
 import (
+	"crypto/ed25519"
 	"io"
 
 	"desource.net/alex/pkg/base58"
@@ -62,3 +63,60 @@ func (k PublicKey) String() string {
 }
 
 type sharedKey [32]byte
+
+// GenerateSigningKey generates an Ed25519 signing key
+// Returns an error if not enough entropy
+func GenerateSigningKey(rand io.Reader) (key SigningKey, err error) {
+	var n int
+	n, err = io.ReadFull(rand, key[:])
+	if err == nil && n != len(key) {
+		err = ErrInsufficientEntropy
+	}
+	return
+}
+
+// SigningKey is the seed of an Ed25519 private key
+type SigningKey [ed25519.SeedSize]byte
+
+func (k SigningKey) String() string {
+	return base58.Encode(k[:])
+}
+
+func DecodeSigningKey(v string) (key SigningKey, err error) {
+	if v == "" {
+		return key, ErrEmptyKey
+	}
+	k := base58.Decode(v) // TODO improve key validation
+	copy(key[:], k)
+	return
+}
+
+func (signingKey SigningKey) VerifyKey() (verifyKey VerifyKey) {
+	publicKey := ed25519.NewKeyFromSeed(signingKey[:]).Public().(ed25519.PublicKey)
+	copy(verifyKey[:], publicKey)
+	return
+}
+
+func (signingKey SigningKey) sign(digest []byte) []byte {
+	return ed25519.Sign(ed25519.NewKeyFromSeed(signingKey[:]), digest)
+}
+
+// VerifyKey is an Ed25519 public key
+type VerifyKey [ed25519.PublicKeySize]byte
+
+func DecodeVerifyKey(v string) (key VerifyKey, err error) {
+	if v == "" {
+		return key, ErrEmptyKey
+	}
+	k := base58.Decode(v) // TODO validate key
+	copy(key[:], k)
+	return
+}
+
+func (k VerifyKey) String() string {
+	return base58.Encode(k[:])
+}
+
+func (verifyKey VerifyKey) verify(digest, signature []byte) bool {
+	return ed25519.Verify(verifyKey[:], digest, signature)
+}
@@ -47,7 +47,7 @@ func TestDecodeKey(t *testing.T) {
 	}
 
 	if !reflect.DeepEqual(privateKey[:], decodedKey[:]) {
-		t.Error("Expected pubicKey\n '%s'\nto equal\n '%s'", privateKey.String(), decodedKey.String())
+		t.Errorf("Expected pubicKey\n '%s'\nto equal\n '%s'", privateKey.String(), decodedKey.String())
 	}
 }
 
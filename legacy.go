@@ -0,0 +1,124 @@
+package alex
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/subtle"
+
+	"desource.net/alex/pkg/blake2b"
+)
+
+// Before version 4 the session key is encrypted into each slot with
+// AES-CTR, keyed by the shared key, with an IV made from the header nonce
+// and the index of the slot. Nothing authenticates the slot itself, so
+// these versions find the key by what it opens: the payload up to version
+// 2, a tag after each slot in version 3. They are only read, never
+// written.
+
+// open decrypts the payload of envelopes before version 2, which is sealed
+// in one piece, and appends the plaintext to dst.
+func (h *header) open(dst, message []byte, privateKey *PrivateKey) (out []byte, err error) {
+	if len(message) < tagLen {
+		return nil, ErrTruncated
+	}
+
+	shared := privateKey.sharedKey(&h.sender)
+
+	// for each recipient
+	for r, slot := range h.slots {
+		sessionKey, err := unwrapSessionKey(&shared, h.nonce, r, slot)
+		if err != nil {
+			return nil, err
+		}
+
+		aesgcm, err := newAEAD(suiteX25519AES256GCM, &sessionKey)
+		if err != nil {
+			return nil, err
+		}
+
+		out, err = aesgcm.Open(dst, h.nonce[:aesgcm.NonceSize()], message, nil)
+		if err == nil {
+			return out, nil
+		}
+		// TODO improve error handling?
+	}
+
+	return nil, ErrFailedToDecrypt
+}
+
+// unwrapSessionKey decrypts the session key in the slot of recipient r.
+func unwrapSessionKey(shared *sharedKey, nonce []byte, r int, slot []byte) (sessionKey sessionKey, err error) {
+	sharedAes, err := aes.NewCipher(shared[:])
+	if err != nil {
+		return sessionKey, err
+	}
+	iv := make([]byte, aes.BlockSize)
+	copy(iv, nonce)
+	// xor with a counter for each recipient
+	iv[0] = nonce[0] ^ byte(r)
+	iv[1] = nonce[1] ^ byte(r>>1)
+	iv[2] = nonce[2] ^ byte(r>>2)
+	iv[3] = nonce[3] ^ byte(r>>3)
+	stream := cipher.NewCTR(sharedAes, iv)
+	stream.XORKeyStream(sessionKey[:], slot)
+	return sessionKey, nil
+}
+
+// unwrapTagged finds the slot whose tag confirms the session key unwrapped
+// with the shared key, and returns the key with the index of the slot.
+func (h *header) unwrapTagged(shared *sharedKey) (*sessionKey, int, error) {
+	for r, slot := range h.slots {
+		sessionKey, err := unwrapSessionKey(shared, h.nonce, r, slot[:sessionKeyLen])
+		if err != nil {
+			return nil, 0, err
+		}
+		tag := slotTag(&sessionKey, h.nonce, slot[:sessionKeyLen])
+		if subtle.ConstantTimeCompare(tag, slot[sessionKeyLen:]) == 1 {
+			return &sessionKey, r, nil
+		}
+	}
+	return nil, 0, ErrFailedToDecrypt
+}
+
+// slotTag returns the tag which confirms the session key unwrapped from a
+// version 3 slot. It covers the wrapped key, so every slot has a different
+// tag.
+func slotTag(key *sessionKey, nonce, wrapped []byte) []byte {
+	h, _ := blake2b.New(&blake2b.Config{
+		Size:   slotTagLen,
+		Key:    key[:],
+		Person: []byte("alex-slot"),
+	})
+	h.Write(nonce)
+	h.Write(wrapped)
+	return h.Sum(nil)
+}
+
+// trySlots finds the session key of envelopes before version 3, which
+// have no slot tags, by opening the first chunk with the key of each slot.
+func (d *decryptReader) trySlots(h *header) error {
+	if d.shared == nil {
+		return ErrFailedToDecrypt
+	}
+	c := &d.chunks[0]
+	if err := d.readFrame(c); err != nil {
+		return err
+	}
+	for r, slot := range h.slots {
+		sessionKey, err := unwrapSessionKey(d.shared, h.nonce, r, slot)
+		if err != nil {
+			return err
+		}
+		aead, err := newAEAD(suiteX25519AES256GCM, &sessionKey)
+		if err != nil {
+			return err
+		}
+		d.chunkNonce = make([]byte, aead.NonceSize())
+		if d.open(aead, c) == nil {
+			d.aead = aead
+			d.slot = r
+			return nil
+		}
+	}
+	return ErrFailedToDecrypt
+}
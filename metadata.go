@@ -0,0 +1,121 @@
+package alex
+
+import (
+	"encoding/binary"
+	"io"
+	"math"
+	"os"
+	"time"
+)
+
+// Metadata describes the file a message came from. It is sealed with the
+// message, so only the recipients learn it.
+type Metadata struct {
+	Name        string // base name of the file
+	Mode        os.FileMode
+	ModTime     time.Time
+	ContentType string // MIME type, if known
+}
+
+// An envelope with metadata sets flagMetadata, and its plaintext starts
+// with the metadata record
+//
+//	length (2) | mode (4) | mtime seconds (8) | mtime nanoseconds (4) |
+//	name length (2) | name | content type length (2) | content type
+//
+// in big-endian, where length is of the rest of the record and an mtime of
+// zero is unset. Any bytes after the known fields are ignored, for fields
+// added later. The record is compressed and padded along with the message.
+const metadataFixedLen = 4 + 8 + 4 + 2 + 2
+
+// marshal returns the metadata record.
+func (md *Metadata) marshal() ([]byte, error) {
+	l := metadataFixedLen + len(md.Name) + len(md.ContentType)
+	if l > math.MaxUint16 {
+		return nil, ErrMetadataTooLarge
+	}
+	out := make([]byte, 2+metadataFixedLen, 2+l)
+	binary.BigEndian.PutUint16(out, uint16(l))
+	binary.BigEndian.PutUint32(out[2:], uint32(md.Mode))
+	var sec int64
+	var nsec uint32
+	if !md.ModTime.IsZero() {
+		sec, nsec = md.ModTime.Unix(), uint32(md.ModTime.Nanosecond())
+	}
+	binary.BigEndian.PutUint64(out[6:], uint64(sec))
+	binary.BigEndian.PutUint32(out[14:], nsec)
+	out = appendString(out[:18], md.Name)
+	return appendString(out, md.ContentType), nil
+}
+
+func appendString(out []byte, s string) []byte {
+	var l [2]byte
+	binary.BigEndian.PutUint16(l[:], uint16(len(s)))
+	return append(append(out, l[:]...), s...)
+}
+
+// readMetadata reads the metadata record from the start of the plaintext.
+func readMetadata(r io.Reader) (*Metadata, error) {
+	var l [2]byte
+	if _, err := io.ReadFull(r, l[:]); err != nil {
+		return nil, malformedMetadata(err)
+	}
+	record := make([]byte, binary.BigEndian.Uint16(l[:]))
+	if _, err := io.ReadFull(r, record); err != nil {
+		return nil, malformedMetadata(err)
+	}
+	if len(record) < 4+8+4 {
+		return nil, ErrMalformedMetadata
+	}
+
+	md := &Metadata{Mode: os.FileMode(binary.BigEndian.Uint32(record))}
+	sec := int64(binary.BigEndian.Uint64(record[4:]))
+	nsec := binary.BigEndian.Uint32(record[12:])
+	if sec != 0 || nsec != 0 {
+		md.ModTime = time.Unix(sec, int64(nsec))
+	}
+	var ok bool
+	rest := record[16:]
+	if md.Name, rest, ok = readString(rest); !ok {
+		return nil, ErrMalformedMetadata
+	}
+	if md.ContentType, _, ok = readString(rest); !ok {
+		return nil, ErrMalformedMetadata
+	}
+	return md, nil
+}
+
+func readString(data []byte) (s string, rest []byte, ok bool) {
+	if len(data) < 2 {
+		return "", nil, false
+	}
+	l := int(binary.BigEndian.Uint16(data))
+	if len(data) < 2+l {
+		return "", nil, false
+	}
+	return string(data[2 : 2+l]), data[2+l:], true
+}
+
+// malformedMetadata maps a plaintext too short for its metadata to
+// ErrMalformedMetadata.
+func malformedMetadata(err error) error {
+	if err == io.EOF || err == io.ErrUnexpectedEOF {
+		return ErrMalformedMetadata
+	}
+	return err
+}
+
+// content returns the reader of the message, after decompressing the
+// plaintext and reading the metadata from its start.
+func (d *decryptReader) content() (r io.Reader, err error) {
+	r = d
+	if d.compressed {
+		r = newDecompressReader(d)
+	}
+	if d.hasMetadata {
+		if d.metadata, err = readMetadata(r); err != nil {
+			return nil, err
+		}
+	}
+	return r, nil
+}
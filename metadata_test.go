@@ -0,0 +1,102 @@
+package alex
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestDecryptWithMetadata(t *testing.T) {
+	sender, _ := generateKeys(t)
+	recipient, recipientPublicKey := generateKeys(t)
+	msg := []byte("%PDF-1.7")
+	md := &Metadata{
+		Name:        "report.pdf",
+		Mode:        0640,
+		ModTime:     time.Date(2020, 3, 1, 12, 30, 0, 500, time.UTC),
+		ContentType: "application/pdf",
+	}
+
+	for _, opts := range []*EncryptOptions{
+		{Metadata: md},
+		{Metadata: md, Compress: true, Pad: true},
+		{Metadata: &Metadata{}},
+	} {
+		enc, err := EncryptWithOptions(msg, sender, opts, recipientPublicKey)
+		if err != nil {
+			t.Fatal(err)
+		}
+		dec, decMD, err := DecryptWithMetadata(enc, recipient, nil)
+		if err != nil {
+			t.Fatalf("Unexpected decrypt error: %s", err)
+		}
+		if !bytes.Equal(dec, msg) {
+			t.Errorf("Expected to be equal\n'%s'\n'%s'", dec, msg)
+		}
+		if decMD == nil || decMD.Name != opts.Metadata.Name || decMD.Mode != opts.Metadata.Mode ||
+			!decMD.ModTime.Equal(opts.Metadata.ModTime) || decMD.ContentType != opts.Metadata.ContentType {
+			t.Errorf("Expected metadata %+v but got %+v", opts.Metadata, decMD)
+		}
+
+		// the metadata is stripped by the other decrypt functions
+		if dec, err := Decrypt(enc, recipient); err != nil || !bytes.Equal(dec, msg) {
+			t.Errorf("Unexpected decrypt of %q: %v", dec, err)
+		}
+		r, streamMD, err := NewDecryptReaderWithMetadata(bytes.NewReader(enc), recipient, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var buf bytes.Buffer
+		if _, err := buf.ReadFrom(r); err != nil || !bytes.Equal(buf.Bytes(), msg) {
+			t.Errorf("Unexpected read of %q: %v", buf.Bytes(), err)
+		}
+		if streamMD == nil || streamMD.Name != opts.Metadata.Name {
+			t.Errorf("Expected metadata %+v but got %+v", opts.Metadata, streamMD)
+		}
+	}
+
+	enc, err := Encrypt(msg, sender, recipientPublicKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, md, err := DecryptWithMetadata(enc, recipient, nil); err != nil || md != nil {
+		t.Errorf("Expected no metadata but got %+v, %v", md, err)
+	}
+
+	large := &Metadata{Name: strings.Repeat("a", 1<<16)}
+	if _, err := EncryptWithOptions(msg, sender, &EncryptOptions{Metadata: large}, recipientPublicKey); err != ErrMetadataTooLarge {
+		t.Errorf("Expected %s but got %v", ErrMetadataTooLarge, err)
+	}
+}
+
+func TestReadMetadata(t *testing.T) {
+	md := &Metadata{Name: "a.txt", Mode: 0600, ContentType: "text/plain"}
+	record, err := md.marshal()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// fields added later are skipped
+	extended := append([]byte{}, record...)
+	extended[1] += 3
+	extended = append(extended, 1, 2, 3, 'x')
+	r := bytes.NewReader(extended)
+	if got, err := readMetadata(r); err != nil || got.Name != md.Name || got.ContentType != md.ContentType {
+		t.Errorf("Expected %+v but got %+v, %v", md, got, err)
+	}
+	if r.Len() != 1 {
+		t.Errorf("Expected the message to follow the record, %d bytes left", r.Len())
+	}
+
+	for _, l := range []int{0, 1, 2, 10, len(record) - 1} {
+		if _, err := readMetadata(bytes.NewReader(record[:l])); err != ErrMalformedMetadata {
+			t.Errorf("%d: Expected %s but got %v", l, ErrMalformedMetadata, err)
+		}
+	}
+	short := []byte{0, 17}
+	short = append(short, record[2:19]...)
+	if _, err := readMetadata(bytes.NewReader(short)); err != ErrMalformedMetadata {
+		t.Errorf("Expected %s but got %v", ErrMalformedMetadata, err)
+	}
+}
@@ -0,0 +1,42 @@
+package alex
+
+import "math/bits"
+
+// A padded envelope sets flagPadded and hides the length of the message
+// inside the AEAD. Every chunk ends with a 0x80 byte followed by zeros, as
+// in ISO/IEC 7816-4, so it holds up to chunkSize-1 bytes of the message
+// and is stripped on its own. The writer adds padding until the chunks are
+// as long as they would be for a message of paddedLen bytes, so only that
+// length is seen outside of the AEAD.
+const (
+	padMarker = 0x80
+
+	// minPaddedLen is the smallest padded length, all messages up to it
+	// look the same.
+	minPaddedLen = 256
+)
+
+// paddedLen returns the length a message of n bytes is padded to, with
+// Padmé: a length of 2^e is rounded up to a multiple of 2^(e-log2(e)-1),
+// which costs at most 12% and leaks O(log log n) bits of the length.
+func paddedLen(n int64) int64 {
+	if n < minPaddedLen {
+		return minPaddedLen
+	}
+	e := bits.Len64(uint64(n)) - 1
+	s := bits.Len64(uint64(e))
+	mask := int64(1)<<uint(e-s) - 1
+	return (n + mask) &^ mask
+}
+
+// unpad returns the message in a padded chunk.
+func unpad(chunk []byte) ([]byte, error) {
+	i := len(chunk) - 1
+	for i >= 0 && chunk[i] == 0 {
+		i--
+	}
+	if i < 0 || chunk[i] != padMarker {
+		return nil, ErrBadPadding
+	}
+	return chunk[:i], nil
+}
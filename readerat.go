@@ -0,0 +1,258 @@
+package alex
+
+import (
+	"bytes"
+	"crypto/cipher"
+	"encoding/binary"
+	"errors"
+	"io"
+	"sort"
+	"sync"
+)
+
+// frameLen is the length of a framed chunk which is not final.
+const frameLen = chunkPrefixLen + chunkSize + tagLen
+
+var errNegativeOffset = errors.New("negative offset")
+
+// decryptReaderAt decrypts the chunks of an envelope out of order. Chunk i
+// is framed at payload offset i*frameLen and sealed with a nonce derived
+// from i, so it can be found and opened on its own.
+type decryptReaderAt struct {
+	ra    io.ReaderAt
+	aead  cipher.AEAD
+	nonce []byte
+	ad    []byte
+
+	offset   int64 // of the payload in ra
+	chunks   int64
+	finalLen int64 // of the final frame
+	chunkLen int64 // of message in a chunk
+	padded   bool
+	boundary int64 // first chunk with padding, -1 until it is known
+
+	skip int64 // metadata at the start of the message
+	size int64 // of the message
+
+	// the last chunk opened, as reads tend to be in order
+	mu         sync.Mutex
+	cached     int64
+	content    []byte
+	frame      []byte
+	plaintext  []byte
+	chunkNonce []byte
+}
+
+// DecryptReaderAt reads a message at any offset, as returned by
+// NewDecryptReaderAt.
+type DecryptReaderAt interface {
+	io.ReaderAt
+
+	// Size returns the length of the message.
+	Size() int64
+}
+
+// NewDecryptReaderAt returns a reader of the message in the envelope of
+// size bytes in ra, which decrypts only the chunks each read touches. The
+// final chunk is opened up front, so an envelope which is cut short fails
+// here.
+//
+// Reading out of order skips the transcript, so the signature and sender
+// of an envelope could not be verified: signed and authenticated
+// envelopes, like compressed ones, can only be read in order and fail with
+// ErrUnsupportedFlags. Envelopes from before version 2 are decrypted into
+// memory.
+func NewDecryptReaderAt(ra io.ReaderAt, size int64, privateKey *PrivateKey) (DecryptReaderAt, error) {
+	return NewDecryptReaderAtWithOptions(ra, size, privateKey, nil)
+}
+
+// NewDecryptReaderAtWithOptions is like NewDecryptReaderAt, with the
+// requirements in opts. Jobs is ignored, as each read opens its chunks.
+func NewDecryptReaderAtWithOptions(ra io.ReaderAt, size int64, privateKey *PrivateKey, opts *DecryptOptions) (DecryptReaderAt, error) {
+	h, err := readHeader(io.NewSectionReader(ra, 0, size))
+	if err != nil {
+		return nil, err
+	}
+	if h.version < version2 {
+		data := make([]byte, size)
+		if _, err := ra.ReadAt(data, 0); err != nil && err != io.EOF {
+			return nil, err
+		}
+		out, _, err := decrypt(nil, data, privateKey, opts)
+		if err != nil {
+			return nil, err
+		}
+		return bytes.NewReader(out), nil
+	}
+	if err := opts.check(h); err != nil {
+		return nil, err
+	}
+	if h.flags&(flagCompressed|flagSigned|flagAuthenticated) != 0 {
+		return nil, ErrUnsupportedFlags
+	}
+
+	// open the session key and the first chunk as a stream would
+	offset := int64(len(h.raw))
+	d, err := newDecryptReader(h, io.NewSectionReader(ra, offset, size-offset), privateKey, opts)
+	if err != nil {
+		return nil, err
+	}
+
+	d.release()
+
+	r := &decryptReaderAt{
+		ra:         ra,
+		aead:       d.aead,
+		nonce:      d.nonce,
+		ad:         d.ad,
+		offset:     offset,
+		chunkLen:   chunkSize,
+		padded:     d.padded,
+		boundary:   -1,
+		cached:     -1,
+		frame:      make([]byte, frameLen),
+		chunkNonce: make([]byte, d.aead.NonceSize()),
+	}
+	if r.padded {
+		r.chunkLen--
+	}
+	payloadLen := size - offset - int64(d.trailerLen)
+	r.chunks, r.finalLen = payloadLen/frameLen, frameLen
+	if rem := payloadLen % frameLen; rem != 0 {
+		r.chunks++
+		r.finalLen = rem
+	}
+	if payloadLen <= 0 || r.finalLen < chunkPrefixLen+tagLen {
+		return nil, ErrTruncated
+	}
+	if r.chunks-1 > maxChunkIndex {
+		return nil, ErrMessageTooLarge
+	}
+
+	final, err := r.open(r.chunks - 1)
+	if err != nil {
+		return nil, err
+	}
+	r.size = (r.chunks-1)*r.chunkLen + int64(len(final))
+	if r.padded {
+		if r.size, err = r.paddedSize(int64(len(final))); err != nil {
+			return nil, err
+		}
+	}
+
+	if d.hasMetadata {
+		sr := io.NewSectionReader(r, 0, r.size)
+		if _, err := readMetadata(sr); err != nil {
+			return nil, err
+		}
+		r.skip, _ = sr.Seek(0, io.SeekCurrent)
+		r.size -= r.skip
+	}
+	return r, nil
+}
+
+// paddedSize returns the length of a padded message, with the chunks full
+// of message before the first one with padding. Any chunk before it which
+// is not full fails to open once it is found.
+func (r *decryptReaderAt) paddedSize(finalLen int64) (int64, error) {
+	var err error
+	contentLen := finalLen
+	b := sort.Search(int(r.chunks-1), func(i int) bool {
+		if err != nil {
+			return true
+		}
+		var c []byte
+		c, err = r.open(int64(i))
+		if int64(len(c)) < r.chunkLen {
+			contentLen = int64(len(c))
+			return true
+		}
+		return false
+	})
+	if err != nil {
+		return 0, err
+	}
+	r.boundary = int64(b)
+	return int64(b)*r.chunkLen + contentLen, nil
+}
+
+// Size returns the length of the message.
+func (r *decryptReaderAt) Size() int64 {
+	return r.size
+}
+
+func (r *decryptReaderAt) ReadAt(p []byte, off int64) (n int, err error) {
+	if off < 0 {
+		return 0, errNegativeOffset
+	}
+	if off >= r.size {
+		return 0, io.EOF
+	}
+	if rest := r.size - off; int64(len(p)) > rest {
+		p, err = p[:rest], io.EOF
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	pos := off + r.skip
+	for n < len(p) {
+		content, openErr := r.open(pos / r.chunkLen)
+		if openErr != nil {
+			return n, openErr
+		}
+		start := pos % r.chunkLen
+		if start >= int64(len(content)) {
+			return n, ErrBadPadding
+		}
+		l := copy(p[n:], content[start:])
+		n += l
+		pos += int64(l)
+	}
+	return n, err
+}
+
+// open reads and opens chunk i, and returns its content, which is valid
+// until the next chunk is opened. The caller holds r.mu, or has the reader
+// to itself.
+func (r *decryptReaderAt) open(i int64) ([]byte, error) {
+	if i == r.cached {
+		return r.content, nil
+	}
+	r.cached = -1
+
+	final := i == r.chunks-1
+	frame := r.frame
+	if final {
+		frame = frame[:r.finalLen]
+	}
+	if n, err := r.ra.ReadAt(frame, r.offset+i*frameLen); n < len(frame) {
+		return nil, truncated(err)
+	}
+
+	prefix, kind := uint32(i), nonceChunk
+	if final {
+		prefix, kind = prefix|finalChunkFlag, nonceFinalChunk
+	}
+	if binary.BigEndian.Uint32(frame) != prefix {
+		return nil, ErrChunkOutOfOrder
+	}
+	chunkNonce(r.chunkNonce, r.nonce, uint32(i), kind)
+	plaintext, err := r.aead.Open(r.plaintext[:0], r.chunkNonce, frame[chunkPrefixLen:], r.ad)
+	if err != nil {
+		return nil, ErrFailedToDecrypt
+	}
+	r.plaintext = plaintext
+	content := plaintext
+	if r.padded {
+		if content, err = unpad(plaintext); err != nil {
+			return nil, err
+		}
+		// the offsets of the message assume full chunks up to the
+		// first one with padding
+		if !final && int64(len(content)) < r.chunkLen && i < r.boundary {
+			return nil, ErrBadPadding
+		}
+	}
+	r.cached, r.content = i, content
+	return content, nil
+}
@@ -0,0 +1,203 @@
+package alex
+
+import (
+	"bytes"
+	"crypto/rand"
+	"io"
+	"io/ioutil"
+	"sync"
+	"testing"
+	"time"
+)
+
+// countingReaderAt counts the bytes read from it.
+type countingReaderAt struct {
+	ra io.ReaderAt
+	n  int64
+}
+
+func (c *countingReaderAt) ReadAt(p []byte, off int64) (int, error) {
+	n, err := c.ra.ReadAt(p, off)
+	c.n += int64(n)
+	return n, err
+}
+
+func TestDecryptReaderAt(t *testing.T) {
+	sender, _ := generateKeys(t)
+	recipient, recipientPublicKey := generateKeys(t)
+	signingKey, _ := GenerateSigningKey(rand.Reader)
+	msg := make([]byte, 3*chunkSize+100)
+	rand.Read(msg)
+
+	for _, opts := range []*EncryptOptions{
+		{},
+		{Pad: true},
+		{AD: []byte("/var/log/app.log")},
+		{Metadata: &Metadata{Name: "app.log", ModTime: time.Now()}, Pad: true},
+	} {
+		enc, err := EncryptWithOptions(msg, sender, opts, recipientPublicKey)
+		if err != nil {
+			t.Fatal(err)
+		}
+		counting := &countingReaderAt{ra: bytes.NewReader(enc)}
+		ra, err := NewDecryptReaderAtWithOptions(counting, int64(len(enc)), recipient, &DecryptOptions{AD: opts.AD})
+		if err != nil {
+			t.Fatalf("Unexpected decrypt error: %s", err)
+		}
+		if size := ra.Size(); size != int64(len(msg)) {
+			t.Errorf("Expected a size of %d but got %d", len(msg), size)
+		}
+
+		for _, tc := range []struct{ off, n int }{
+			{0, 10}, {chunkSize - 5, 10}, {2*chunkSize + 1, chunkSize}, {len(msg) - 10, 10}, {0, len(msg)},
+		} {
+			p := make([]byte, tc.n)
+			n, err := ra.ReadAt(p, int64(tc.off))
+			if n != tc.n || (err != nil && err != io.EOF) {
+				t.Fatalf("%d: Expected to read %d bytes but got %d, %v", tc.off, tc.n, n, err)
+			}
+			if !bytes.Equal(p, msg[tc.off:tc.off+tc.n]) {
+				t.Errorf("%d: Read bytes not equal", tc.off)
+			}
+		}
+		p := make([]byte, 20)
+		if n, err := ra.ReadAt(p, int64(len(msg)-10)); n != 10 || err != io.EOF {
+			t.Errorf("Expected 10 bytes and EOF but got %d, %v", n, err)
+		}
+
+		// reading the tail only opens the chunks it touches
+		counting.n = 0
+		ra.ReadAt(p[:10], int64(len(msg)-10))
+		if counting.n > frameLen {
+			t.Errorf("Expected to read one chunk but read %d bytes", counting.n)
+		}
+
+		// reads may run in parallel
+		var wg sync.WaitGroup
+		for i := 0; i < 4; i++ {
+			wg.Add(1)
+			go func(off int) {
+				defer wg.Done()
+				p := make([]byte, 100)
+				if _, err := ra.ReadAt(p, int64(off)); err != nil || !bytes.Equal(p, msg[off:off+100]) {
+					t.Errorf("%d: Unexpected read of %d bytes: %v", off, len(p), err)
+				}
+			}(i * chunkSize)
+		}
+		wg.Wait()
+
+		// small reads in order open each chunk once
+		counting.n = 0
+		for off := 0; off < len(msg); off += 8192 {
+			ra.ReadAt(p[:10], int64(off))
+		}
+		if counting.n > int64(len(enc)) {
+			t.Errorf("Expected to read each chunk once but read %d bytes of %d", counting.n, len(enc))
+		}
+	}
+
+	enc, err := Encrypt(msg, sender, recipientPublicKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// cut at a chunk boundary
+	cut := enc[:len(enc)-(len(msg)-3*chunkSize)-chunkPrefixLen-tagLen]
+	if _, err := NewDecryptReaderAt(bytes.NewReader(cut), int64(len(cut)), recipient); err != ErrChunkOutOfOrder {
+		t.Errorf("Expected %s but got %v", ErrChunkOutOfOrder, err)
+	}
+
+	// a tampered chunk only fails the reads which touch it
+	tampered := append([]byte{}, enc...)
+	h, _ := ParseHeader(bytes.NewReader(enc))
+	tampered[h.PayloadOffset+frameLen+chunkPrefixLen] ^= 1
+	ra, err := NewDecryptReaderAt(bytes.NewReader(tampered), int64(len(tampered)), recipient)
+	if err != nil {
+		t.Fatal(err)
+	}
+	p := make([]byte, 10)
+	if _, err := ra.ReadAt(p, 0); err != nil {
+		t.Errorf("Unexpected read error: %s", err)
+	}
+	if _, err := ra.ReadAt(p, chunkSize+1); err != ErrFailedToDecrypt {
+		t.Errorf("Expected %s but got %v", ErrFailedToDecrypt, err)
+	}
+
+	// a padded chunk before the one the message ends in moves the offsets
+	var short bytes.Buffer
+	w, err := NewEncryptWriterWithOptions(&short, sender, &EncryptOptions{Pad: true}, recipientPublicKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	e := w.(*encryptWriter)
+	e.Write(msg[:10])
+	if err := e.flush(false, e.chunkLen-10); err != nil {
+		t.Fatal(err)
+	}
+	e.Write(msg[10:])
+	if err := e.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := Decrypt(short.Bytes(), recipient); err != nil {
+		t.Fatalf("Unexpected decrypt error: %s", err)
+	}
+	ra, err = NewDecryptReaderAt(bytes.NewReader(short.Bytes()), int64(short.Len()), recipient)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := ra.ReadAt(p, 100); err != ErrBadPadding {
+		t.Errorf("Expected %s but got %v", ErrBadPadding, err)
+	}
+
+	bound, _ := EncryptWithOptions(msg, sender, &EncryptOptions{AD: []byte("a")}, recipientPublicKey)
+	if _, err := NewDecryptReaderAtWithOptions(bytes.NewReader(bound), int64(len(bound)), recipient, &DecryptOptions{AD: []byte("b")}); err != ErrFailedToDecrypt {
+		t.Errorf("Expected %s but got %v", ErrFailedToDecrypt, err)
+	}
+
+	// the signature and tags can only be verified in order
+	for _, opts := range []*EncryptOptions{{Compress: true}, {SigningKey: &signingKey}, {Authenticate: true}} {
+		enc, _ := EncryptWithOptions(msg, sender, opts, recipientPublicKey)
+		if _, err := NewDecryptReaderAt(bytes.NewReader(enc), int64(len(enc)), recipient); err != ErrUnsupportedFlags {
+			t.Errorf("Expected %s but got %v", ErrUnsupportedFlags, err)
+		}
+	}
+}
+
+func TestDecryptReaderAtArchive(t *testing.T) {
+	sender, _ := generateKeys(t)
+	recipient, recipientPublicKey := generateKeys(t)
+
+	var enc bytes.Buffer
+	a, err := NewArchiveWriter(&enc, sender, nil, recipientPublicKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := a.AddDir("testdata/golden"); err != nil {
+		t.Fatal(err)
+	}
+	if err := a.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	ra, err := NewDecryptReaderAt(bytes.NewReader(enc.Bytes()), int64(enc.Len()), recipient)
+	if err != nil {
+		t.Fatal(err)
+	}
+	index, err := ReadArchiveIndex(ra, ra.Size())
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, entry := range index {
+		if entry.Name != "default" {
+			continue
+		}
+		content := make([]byte, entry.Size)
+		if _, err := ra.ReadAt(content, entry.Offset); err != nil {
+			t.Fatal(err)
+		}
+		if expected, _ := ioutil.ReadFile("testdata/golden/default"); !bytes.Equal(content, expected) {
+			t.Error("Archive entry not equal")
+		}
+		return
+	}
+	t.Error("Expected an entry for default")
+}
@@ -0,0 +1,179 @@
+package alex
+
+import (
+	"bytes"
+	"crypto/rand"
+	"io"
+	"math"
+)
+
+// Recrypt rewraps the session key of an envelope for a new set of
+// recipients. The payload is copied unchanged, its nonces only depend on
+// the nonce of the header. Peers which are removed but kept the session key
+// can still read the payload.
+//
+// If privateKey is the key the envelope was sent from, the slots of
+// removePeers are dropped and slots for addPeers are added, the others are
+// kept. The session key is found through the slot of the sender or of one
+// of the peers.
+//
+// Any other holder of the session key, such as a recipient or the
+// recipient of an anonymous envelope, can't wrap keys from the sender, so
+// the envelope is sent again from a fresh ephemeral key. Its slots can't be
+// kept: addPeers are the whole new set of recipients, less any of
+// removePeers.
+//
+// Signed and authenticated envelopes can't be recrypted, as the signature
+// and tags cover the header.
+func Recrypt(envelope []byte, privateKey *PrivateKey, addPeers, removePeers []*PublicKey) ([]byte, error) {
+	var out bytes.Buffer
+	out.Grow(len(envelope) + len(addPeers)*(stanzaHeaderLen+x25519SlotLen))
+	if err := RecryptStream(&out, bytes.NewReader(envelope), privateKey, addPeers, removePeers); err != nil {
+		return nil, err
+	}
+	return out.Bytes(), nil
+}
+
+// RecryptStream is like Recrypt, it reads the envelope from r and writes
+// the recrypted envelope to w. Only the header is held in memory, the
+// payload is copied as it is read. Nothing is written if the header can't
+// be recrypted.
+func RecryptStream(w io.Writer, r io.Reader, privateKey *PrivateKey, addPeers, removePeers []*PublicKey) error {
+	h, err := readHeader(r)
+	if err != nil {
+		return err
+	}
+	switch {
+	case h.version < version4:
+		return ErrUnsupportedVersion
+	case h.flags&^payloadFlags != 0:
+		return ErrUnsupportedFlags
+	}
+
+	var header []byte
+	if privateKey.PublicKey() == h.sender {
+		header, err = h.recrypt(privateKey, addPeers, removePeers)
+	} else {
+		header, err = h.resend(privateKey, addPeers, removePeers)
+	}
+	if err != nil {
+		return err
+	}
+	if _, err := w.Write(header); err != nil {
+		return err
+	}
+	_, err = io.Copy(w, r)
+	return err
+}
+
+// recrypt returns the header with the slots of removePeers dropped and
+// slots for addPeers added, wrapped by the sender.
+func (h *header) recrypt(privateKey *PrivateKey, addPeers, removePeers []*PublicKey) ([]byte, error) {
+	var key *sessionKey
+	removed := make([]bool, len(h.slots))
+	for _, peer := range removePeers {
+		shared := privateKey.sharedKey(peer)
+		if k, r, err := h.unwrap(&x25519Identity{shared}); err == nil {
+			key, removed[r] = k, true
+		}
+	}
+
+	var added []*sharedKey
+	for _, peer := range addPeers {
+		shared := privateKey.sharedKey(peer)
+		if k, r, err := h.unwrap(&x25519Identity{shared}); err == nil && !removed[r] {
+			key = k // already a recipient
+			continue
+		}
+		added = append(added, &shared)
+	}
+
+	if key == nil {
+		self := privateKey.PublicKey()
+		shared := privateKey.sharedKey(&self)
+		var err error
+		if key, _, err = h.unwrap(&x25519Identity{shared}); err != nil {
+			return nil, err
+		}
+	}
+
+	n := len(added)
+	for r := range h.slots {
+		if !removed[r] {
+			n++
+		}
+	}
+	if n > math.MaxUint16 {
+		return nil, ErrTooManyRecipients
+	}
+
+	ad := h.slotAD()
+	out := make([]byte, len(ad), len(h.raw)+n*(stanzaHeaderLen+x25519SlotLen))
+	copy(out, ad)
+	out = appendRecipientCount(out, n)
+	for r, body := range h.slots {
+		if !removed[r] {
+			out = appendSlot(out, h.version, h.types[r], body)
+		}
+	}
+	return h.appendSlots(out, ad, key, added)
+}
+
+// resend returns the header sent from a fresh ephemeral key to addPeers,
+// less removePeers, with the session key found through the slot of
+// privateKey.
+func (h *header) resend(privateKey *PrivateKey, addPeers, removePeers []*PublicKey) ([]byte, error) {
+	key, _, err := h.unwrap(&x25519Identity{privateKey.sharedKey(&h.sender)})
+	if err != nil {
+		return nil, err
+	}
+	if len(addPeers) > math.MaxUint16 {
+		return nil, ErrTooManyRecipients
+	}
+
+	ephemeralKey, err := GeneratePrivateKey(rand.Reader)
+	if err != nil {
+		return nil, err
+	}
+	publicKey := ephemeralKey.PublicKey()
+
+	var added []*sharedKey
+peers:
+	for _, peer := range addPeers {
+		for _, removed := range removePeers {
+			if *peer == *removed {
+				continue peers
+			}
+		}
+		shared := ephemeralKey.sharedKey(peer)
+		added = append(added, &shared)
+	}
+
+	out := make([]byte, 0, len(h.raw)+len(added)*(stanzaHeaderLen+x25519SlotLen))
+	out = append(out, h.raw[:prefixLen]...)
+	out = append(out, h.nonce...)
+	out = append(out, publicKey[:]...)
+	ad := out
+	out = appendRecipientCount(out, len(added))
+	return h.appendSlots(out, ad, key, added)
+}
+
+// appendRecipientCount appends the count of n recipients to out.
+func appendRecipientCount(out []byte, n int) []byte {
+	var count [maxRecipientCountLen16]byte
+	l := writeRecipientCount(count[:], uint16(n))
+	return append(out, count[:l]...)
+}
+
+// appendSlots appends a slot with the session key wrapped with each of the
+// shared keys to out.
+func (h *header) appendSlots(out, ad []byte, key *sessionKey, shared []*sharedKey) ([]byte, error) {
+	for _, s := range shared {
+		body := make([]byte, x25519SlotLen)
+		if err := wrapSessionKey(h.suite, body, s, h.nonce, ad, key[:]); err != nil {
+			return nil, err
+		}
+		out = appendSlot(out, h.version, StanzaX25519, body)
+	}
+	return out, nil
+}
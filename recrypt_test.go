@@ -0,0 +1,125 @@
+package alex
+
+import (
+	"bytes"
+	"testing"
+)
+
+func TestRecrypt(t *testing.T) {
+	sender, senderPublicKey := generateKeys(t)
+	recipient1, recipientPublicKey1 := generateKeys(t)
+	recipient2, recipientPublicKey2 := generateKeys(t)
+	recipient3, recipientPublicKey3 := generateKeys(t)
+	msg := make([]byte, chunkSize+1)
+
+	enc, err := Encrypt(msg, sender, senderPublicKey, recipientPublicKey1, recipientPublicKey2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	h, err := readHeader(bytes.NewReader(enc))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	recrypted, err := Recrypt(enc, sender, []*PublicKey{recipientPublicKey3, recipientPublicKey1}, []*PublicKey{recipientPublicKey2})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(recrypted[len(recrypted)-payloadLen(len(msg)):], enc[len(h.raw):]) {
+		t.Error("Expected the payload to be unchanged")
+	}
+	r, err := readHeader(bytes.NewReader(recrypted))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(r.slots) != 3 {
+		t.Errorf("Expected 3 slots but got %d", len(r.slots))
+	}
+
+	for _, recipient := range []*PrivateKey{sender, recipient1, recipient3} {
+		dec, err := Decrypt(recrypted, recipient)
+		if err != nil {
+			t.Fatalf("Unexpected decrypt error: %s", err)
+		}
+		if !bytes.Equal(dec, msg) {
+			t.Error("Decrypted message not equal")
+		}
+	}
+	if _, err := Decrypt(recrypted, recipient2); err != ErrFailedToDecrypt {
+		t.Errorf("Expected %s but got %v", ErrFailedToDecrypt, err)
+	}
+}
+
+func TestRecryptRecipient(t *testing.T) {
+	sender, _ := generateKeys(t)
+	recipient1, recipientPublicKey1 := generateKeys(t)
+	recipient2, recipientPublicKey2 := generateKeys(t)
+	recipient3, recipientPublicKey3 := generateKeys(t)
+	msg := make([]byte, chunkSize+1)
+
+	for _, from := range []*PrivateKey{sender, nil} {
+		enc, err := Encrypt(msg, from, recipientPublicKey1, recipientPublicKey2)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		// a recipient sends the envelope again, to a new set
+		var recrypted bytes.Buffer
+		peers := []*PublicKey{recipientPublicKey1, recipientPublicKey2, recipientPublicKey3}
+		if err := RecryptStream(&recrypted, bytes.NewReader(enc), recipient1, peers, []*PublicKey{recipientPublicKey2}); err != nil {
+			t.Fatal(err)
+		}
+		h, _ := readHeader(bytes.NewReader(enc))
+		r, err := readHeader(bytes.NewReader(recrypted.Bytes()))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(r.slots) != 2 || r.sender == h.sender {
+			t.Errorf("Expected 2 slots from a new sender but got %d from %s", len(r.slots), &r.sender)
+		}
+		if !bytes.Equal(recrypted.Bytes()[len(r.raw):], enc[len(h.raw):]) {
+			t.Error("Expected the payload to be unchanged")
+		}
+
+		for _, recipient := range []*PrivateKey{recipient1, recipient3} {
+			if dec, err := Decrypt(recrypted.Bytes(), recipient); err != nil || !bytes.Equal(dec, msg) {
+				t.Errorf("Unexpected decrypt error: %v", err)
+			}
+		}
+		if _, err := Decrypt(recrypted.Bytes(), recipient2); err != ErrFailedToDecrypt {
+			t.Errorf("Expected %s but got %v", ErrFailedToDecrypt, err)
+		}
+	}
+}
+
+func TestRecryptErrors(t *testing.T) {
+	sender, _ := generateKeys(t)
+	_, recipientPublicKey := generateKeys(t)
+	other, otherPublicKey := generateKeys(t)
+	msg := []byte("Hello World")
+
+	enc, err := Encrypt(msg, sender, recipientPublicKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	authenticated, err := EncryptWithOptions(msg, sender, &EncryptOptions{Authenticate: true}, recipientPublicKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, tc := range []struct {
+		name   string
+		data   []byte
+		key    *PrivateKey
+		remove []*PublicKey
+		err    error
+	}{
+		{"not a recipient", enc, other, nil, ErrFailedToDecrypt},
+		{"no slot of the sender", enc, sender, nil, ErrFailedToDecrypt},
+		{"authenticated", authenticated, sender, []*PublicKey{recipientPublicKey}, ErrUnsupportedFlags},
+	} {
+		if _, err := Recrypt(tc.data, tc.key, []*PublicKey{otherPublicKey}, tc.remove); err != tc.err {
+			t.Errorf("%s: Expected %s but got %v", tc.name, tc.err, err)
+		}
+	}
+}
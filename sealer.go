@@ -0,0 +1,50 @@
+package alex
+
+import (
+	"io"
+	"math"
+)
+
+// Sealer encrypts many messages from one sender to the same peers. The key
+// the sender shares with each peer is computed once, by NewSealer, so each
+// message only costs a session key and the wrapping of it. A Sealer is
+// safe for concurrent use by multiple goroutines.
+type Sealer struct {
+	publicKey  PublicKey
+	recipients []Recipient
+}
+
+// NewSealer returns a Sealer of envelopes from privateKey to each of the
+// peers. Unlike Encrypt it needs a private key: an ephemeral key shared by
+// every message would tie them together.
+func NewSealer(privateKey *PrivateKey, peerPublicKeys ...*PublicKey) (*Sealer, error) {
+	if privateKey == nil {
+		return nil, ErrAnonymousSender
+	}
+	if len(peerPublicKeys) > math.MaxUint16 {
+		return nil, ErrTooManyRecipients
+	}
+	publicKey, recipients, err := x25519Recipients(nil, privateKey, peerPublicKeys)
+	if err != nil {
+		return nil, err
+	}
+	return &Sealer{publicKey, recipients}, nil
+}
+
+// Encrypt is like EncryptWithOptions, from the sender to the peers of the
+// Sealer.
+func (s *Sealer) Encrypt(plaintext []byte, opts *EncryptOptions) ([]byte, error) {
+	out := make([]byte, 0, headerLen(version5, opts.suite(), len(s.recipients))+payloadLen(len(plaintext)))
+	return s.EncryptTo(out, plaintext, opts)
+}
+
+// EncryptTo is like EncryptTo, from the sender to the peers of the Sealer.
+func (s *Sealer) EncryptTo(dst, plaintext []byte, opts *EncryptOptions) ([]byte, error) {
+	return sealTo(dst, plaintext, &s.publicKey, s.recipients, opts)
+}
+
+// NewEncryptWriter is like NewEncryptWriterWithOptions, from the sender to
+// the peers of the Sealer.
+func (s *Sealer) NewEncryptWriter(w io.Writer, opts *EncryptOptions) (EncryptWriter, error) {
+	return sealWriter(w, &s.publicKey, s.recipients, opts, 0)
+}
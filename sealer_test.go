@@ -0,0 +1,96 @@
+package alex
+
+import (
+	"bytes"
+	"fmt"
+	"sync"
+	"testing"
+)
+
+func TestSealer(t *testing.T) {
+	sender, senderPublicKey := generateKeys(t)
+	recipient1, recipientPublicKey1 := generateKeys(t)
+	recipient2, recipientPublicKey2 := generateKeys(t)
+
+	s, err := NewSealer(sender, recipientPublicKey1, recipientPublicKey2)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var wg sync.WaitGroup
+	errs := make(chan error, 8)
+	for i := 0; i < cap(errs); i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			msg := []byte(fmt.Sprintf("Hello World %d", i))
+			opts := &EncryptOptions{Authenticate: true, Pad: i%2 == 0}
+			for j := 0; j < 10; j++ {
+				enc, err := s.Encrypt(msg, opts)
+				if err != nil {
+					errs <- err
+					return
+				}
+				for _, recipient := range []*PrivateKey{recipient1, recipient2} {
+					dec, from, err := DecryptAuthenticated(enc, recipient)
+					if err != nil {
+						errs <- err
+						return
+					}
+					if !bytes.Equal(dec, msg) || *from != *senderPublicKey {
+						errs <- fmt.Errorf("unexpected message %q from %s", dec, from)
+						return
+					}
+				}
+			}
+		}(i)
+	}
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		t.Error(err)
+	}
+
+	// recipients of the options are added to the peers of the Sealer
+	recipient3, recipientPublicKey3 := generateKeys(t)
+	opts := &EncryptOptions{Recipients: []Recipient{&x25519Recipient{sender.sharedKey(recipientPublicKey3)}}}
+	enc, err := s.Encrypt([]byte(exampleMsg), opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if dec, err := Decrypt(enc, recipient3); err != nil || string(dec) != exampleMsg {
+		t.Errorf("Unexpected decrypt of %q: %v", dec, err)
+	}
+	if len(s.recipients) != 2 {
+		t.Errorf("Expected the peers of the Sealer to be left as they are but got %d", len(s.recipients))
+	}
+
+	if _, err := NewSealer(nil, recipientPublicKey1); err != ErrAnonymousSender {
+		t.Errorf("Expected %s but got %v", ErrAnonymousSender, err)
+	}
+}
+
+func BenchmarkSealer(b *testing.B) {
+	sender, _ := exampleKeys(b)
+	_, recipientPublicKey := exampleKeys(b)
+	peers := []*PublicKey{recipientPublicKey, recipientPublicKey, recipientPublicKey, recipientPublicKey}
+	msg := make([]byte, 256)
+	enc := make([]byte, 0, 1024)
+
+	b.Run("Encrypt", func(b *testing.B) {
+		b.ReportAllocs()
+		for i := 0; i < b.N; i++ {
+			enc, _ = EncryptTo(enc[:0], msg, sender, nil, peers...)
+		}
+	})
+	b.Run("Sealer", func(b *testing.B) {
+		s, err := NewSealer(sender, peers...)
+		if err != nil {
+			b.Fatal(err)
+		}
+		b.ReportAllocs()
+		for i := 0; i < b.N; i++ {
+			enc, _ = s.EncryptTo(enc[:0], msg, nil)
+		}
+	})
+}
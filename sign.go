@@ -0,0 +1,25 @@
+package alex
+
+import (
+	"crypto/ed25519"
+	"hash"
+
+	"desource.net/alex/pkg/blake2b"
+)
+
+// A signed envelope sets flagSigned and carries the verify key of the
+// signer, sealed under the session key, after the recipient slots. The
+// payload is followed by the sealed signature of the transcript, a hash
+// of everything before it. Both are sealed so only recipients learn who
+// signed the message.
+const (
+	sealedVerifyKeyLen = len(VerifyKey{}) + tagLen
+	sealedSignatureLen = ed25519.SignatureSize + tagLen
+)
+
+// newTranscript returns the hash which is signed and authenticated,
+// covering the header and the framed ciphertext.
+func newTranscript() hash.Hash {
+	h, _ := blake2b.New(&blake2b.Config{Person: []byte("alex-signature")})
+	return h
+}
@@ -0,0 +1,110 @@
+package alex
+
+import (
+	"bytes"
+	"crypto/rand"
+	"io"
+	"io/ioutil"
+	"testing"
+)
+
+func TestEncryptSigned(t *testing.T) {
+	sender, _ := generateKeys(t)
+	recipient, recipientPublicKey := generateKeys(t)
+	signingKey, err := GenerateSigningKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	verifyKey := signingKey.VerifyKey()
+
+	for _, n := range []int{0, 11, chunkSize, 2*chunkSize + 1} {
+		msg := make([]byte, n)
+		if _, err := io.ReadFull(rand.Reader, msg); err != nil {
+			t.Fatal(err)
+		}
+		enc, err := EncryptWithOptions(msg, sender, &EncryptOptions{SigningKey: &signingKey}, recipientPublicKey)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		dec, signer, err := DecryptVerified(enc, recipient)
+		if err != nil {
+			t.Fatalf("%d: Unexpected decrypt error: %s", n, err)
+		}
+		if !bytes.Equal(dec, msg) {
+			t.Errorf("%d: Decrypted message not equal", n)
+		}
+		if *signer != verifyKey {
+			t.Errorf("%d: Expected signer %s but got %s", n, verifyKey, signer)
+		}
+
+		r, err := NewDecryptReaderWithOptions(bytes.NewReader(enc), recipient, &DecryptOptions{Signer: &verifyKey})
+		if err != nil {
+			t.Fatalf("%d: Unexpected decrypt error: %s", n, err)
+		}
+		if dec, err := ioutil.ReadAll(r); err != nil || !bytes.Equal(dec, msg) {
+			t.Errorf("%d: Expected to read message, got error %v", n, err)
+		}
+	}
+}
+
+func TestDecryptSignedErrors(t *testing.T) {
+	sender, _ := generateKeys(t)
+	recipient, recipientPublicKey := generateKeys(t)
+	signingKey, _ := GenerateSigningKey(rand.Reader)
+	otherKey, _ := GenerateSigningKey(rand.Reader)
+	verifyKey := signingKey.VerifyKey()
+	otherVerifyKey := otherKey.VerifyKey()
+
+	msg := []byte("Hello World")
+	unsigned, err := Encrypt(msg, sender, recipientPublicKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	signed, err := EncryptWithOptions(msg, sender, &EncryptOptions{SigningKey: &signingKey}, recipientPublicKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	badSignature := append([]byte(nil), signed...)
+	badSignature[len(badSignature)-1] ^= 1
+
+	tampered := append([]byte(nil), signed...)
+	tampered[len(tampered)-sealedSignatureLen-1] ^= 1
+
+	// a recipient knows the session key and can seal another payload, but
+	// not sign it
+	h, err := readHeader(bytes.NewReader(signed))
+	if err != nil {
+		t.Fatal(err)
+	}
+	shared := recipient.sharedKey(&h.sender)
+	sessionKey, _, _ := h.unwrap(&x25519Identity{shared})
+	aead, _ := newAEAD(h.suite, sessionKey)
+	nonce := make([]byte, aead.NonceSize())
+	chunkNonce(nonce, h.nonce, 0, nonceFinalChunk)
+	forged := append([]byte(nil), h.raw...)
+	forged = append(forged, 0x80, 0, 0, 0)
+	forged = aead.Seal(forged, nonce, []byte("Hello Moon!"), nil)
+	forged = append(forged, signed[len(signed)-sealedSignatureLen:]...)
+
+	for _, tc := range []struct {
+		name string
+		data []byte
+		opts *DecryptOptions
+		err  error
+	}{
+		{"unsigned", unsigned, &DecryptOptions{Signer: &verifyKey}, ErrNotSigned},
+		{"other signer", signed, &DecryptOptions{Signer: &otherVerifyKey}, ErrUnexpectedSigner},
+		{"bad signature", badSignature, nil, ErrBadSignature},
+		{"tampered", tampered, nil, ErrFailedToDecrypt},
+		{"forged", forged, nil, ErrBadSignature},
+	} {
+		if _, err := DecryptWithOptions(tc.data, recipient, tc.opts); err != tc.err {
+			t.Errorf("%s: Expected %s but got %v", tc.name, tc.err, err)
+		}
+	}
+
+	if _, _, err := DecryptVerified(unsigned, recipient); err != ErrNotSigned {
+		t.Errorf("Expected %s but got %v", ErrNotSigned, err)
+	}
+}
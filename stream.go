@@ -0,0 +1,960 @@
+package alex
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/cipher"
+	"encoding/binary"
+	"errors"
+	"hash"
+	"io"
+	"io/ioutil"
+	"sync"
+)
+
+// From version 2 the payload is split into chunks of chunkSize bytes, each
+// sealed on its own (STREAM construction). Every chunk is framed as
+//
+//	index (4) | sealed chunk
+//
+// where the top bit of the big-endian index marks the final chunk. Only the
+// final chunk may be shorter than chunkSize. The index and final flag are
+// also part of the chunk nonce, so any change to them fails authentication.
+const (
+	chunkSize      = 64 * 1024
+	chunkPrefixLen = 4
+	tagLen         = 16
+
+	finalChunkFlag = 1 << 31
+	maxChunkIndex  = finalChunkFlag - 1
+)
+
+// Everything sealed under the session key has a nonce of its own kind.
+const (
+	nonceChunk byte = iota
+	nonceFinalChunk
+	nonceVerifyKey
+	nonceSignature
+)
+
+var (
+	errClosed       = errors.New("write to closed writer")
+	errClosedReader = errors.New("read from closed reader")
+)
+
+// chunk is a chunk of the payload. With more than one job chunks are
+// sealed and opened by a pipeline, and written or read in order.
+type chunk struct {
+	index     uint32
+	final     bool
+	nonce     []byte
+	frame     []byte // index and sealed chunk
+	sealed    []byte // of the frame, when reading
+	plaintext []byte
+	content   []byte        // plaintext without padding
+	err       error         // reading or opening the chunk
+	done      chan struct{} // once the pipeline is done with the chunk
+}
+
+// chunkBufLen is the capacity of pooled chunk buffers, enough for a
+// framed chunk, or for a sealed chunk and a short trailer.
+const chunkBufLen = chunkPrefixLen + chunkSize + 256
+
+// chunkPool reuses chunk buffers across envelopes, as each one would
+// otherwise allocate several for even the shortest message.
+// It holds array pointers, which unlike slices are put without an
+// allocation.
+var chunkPool = sync.Pool{
+	New: func() interface{} {
+		return new([chunkBufLen]byte)
+	},
+}
+
+// getChunkBuf returns a buffer of length n, from the pool if it fits.
+func getChunkBuf(n int) []byte {
+	if n > chunkBufLen {
+		return make([]byte, n)
+	}
+	return chunkPool.Get().(*[chunkBufLen]byte)[:n]
+}
+
+// putChunkBuf returns a buffer from getChunkBuf to the pool, it must not be
+// used after.
+func putChunkBuf(b []byte) {
+	if cap(b) == chunkBufLen {
+		chunkPool.Put((*[chunkBufLen]byte)(b[:chunkBufLen]))
+	}
+}
+
+// pipeline seals or opens chunks on a worker per job, and hands them back
+// in the order they were submitted. The chunks are taken from free, there
+// are two per job, which bounds how far reading or writing the frames in
+// order runs ahead of the workers.
+type pipeline struct {
+	free  chan *chunk // to be filled and submitted
+	work  chan *chunk
+	order chan *chunk
+	quit  chan struct{} // stops reading ahead
+
+	mu  sync.Mutex
+	err error // writing the frames
+}
+
+// newPipeline starts the workers of a pipeline of n chunks, which call f
+// on each chunk submitted. The caller fills free.
+func newPipeline(n, jobs int, f func(c *chunk)) *pipeline {
+	p := &pipeline{
+		free:  make(chan *chunk, n),
+		work:  make(chan *chunk, n),
+		order: make(chan *chunk, n),
+		quit:  make(chan struct{}),
+	}
+	for i := 0; i < jobs; i++ {
+		go func() {
+			for c := range p.work {
+				f(c)
+				c.done <- struct{}{}
+			}
+		}()
+	}
+	return p
+}
+
+// submit hands c to the workers, or straight back if it failed to be read.
+func (p *pipeline) submit(c *chunk) {
+	if c.done == nil {
+		c.done = make(chan struct{}, 1)
+	}
+	if c.err != nil {
+		c.done <- struct{}{}
+	} else {
+		p.work <- c
+	}
+	p.order <- c
+}
+
+// next returns the next chunk once it is done, or false once the pipeline
+// is closed and every chunk has been returned.
+func (p *pipeline) next() (*chunk, bool) {
+	c, ok := <-p.order
+	if ok {
+		<-c.done
+	}
+	return c, ok
+}
+
+// close stops the workers once the chunks submitted are done.
+func (p *pipeline) close() {
+	close(p.work)
+	close(p.order)
+}
+
+// fail records the first error writing the frames.
+func (p *pipeline) fail(err error) {
+	p.mu.Lock()
+	if p.err == nil {
+		p.err = err
+	}
+	p.mu.Unlock()
+}
+
+// failed returns the error writing the frames, if any.
+func (p *pipeline) failed() error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.err
+}
+
+// pipelineChunks returns the number of chunks to seal or open with jobs,
+// one without a pipeline.
+func pipelineChunks(jobs int) int {
+	if jobs > 1 {
+		return 2 * jobs
+	}
+	return 1
+}
+
+// chunkNonce fills dst with a nonce for the session key, the header nonce
+// followed by the chunk index and the kind of nonce.
+func chunkNonce(dst, nonce []byte, index uint32, kind byte) {
+	n := len(dst)
+	copy(dst[:n-5], nonce)
+	binary.BigEndian.PutUint32(dst[n-5:], index)
+	dst[n-1] = kind
+}
+
+// payloadLen returns the length of the chunked payload for n bytes of
+// plaintext.
+func payloadLen(n int) int {
+	chunks := n / chunkSize
+	if n%chunkSize != 0 || n == 0 {
+		chunks++
+	}
+	return n + chunks*(chunkPrefixLen+tagLen)
+}
+
+type encryptWriter struct {
+	w     io.Writer
+	aead  cipher.AEAD
+	nonce []byte
+	ad    []byte // digest of the associated data
+
+	signingKey *SigningKey
+	recipients []Recipient // to authenticate
+	random     io.Reader   // for the tags of random slots
+	transcript hash.Hash   // to sign or authenticate
+
+	padded   bool
+	chunkLen int   // of message in a chunk
+	n        int64 // of message written
+
+	index      uint32
+	chunkNonce []byte
+	buf        []byte     // plaintext of the pending chunk
+	chunks     []chunk    // sealed in place, or by the pipeline
+	pipe       *pipeline  // with more than one job
+	drained    chan error // once the pipeline has written every frame
+	err        error
+}
+
+// EncryptWriter is the writer of an envelope. Close writes the final chunk,
+// and Abort gives up on the envelope.
+type EncryptWriter interface {
+	io.WriteCloser
+
+	// Abort stops the writer without the final chunk, so what was
+	// written of the envelope fails to decrypt. Like Close it releases
+	// the writer, it returns the first error writing the envelope, if
+	// any.
+	Abort() error
+}
+
+// NewEncryptWriter returns a writer which encrypts everything written to
+// it for each of the peers, and writes the envelope to w. The header is
+// written immediately, the payload is written a chunk at a time so memory
+// use does not depend on the message size. As with Encrypt, a nil
+// privateKey sends the message anonymously.
+//
+// The caller must call Close to write the final chunk, or Abort if the
+// message can't be written in full. A writer which fails releases itself.
+func NewEncryptWriter(w io.Writer, privateKey *PrivateKey, peerPublicKeys ...*PublicKey) (EncryptWriter, error) {
+	return NewEncryptWriterWithOptions(w, privateKey, nil, peerPublicKeys...)
+}
+
+// NewEncryptWriterWithOptions is like NewEncryptWriter, with the optional
+// settings in opts.
+func NewEncryptWriterWithOptions(w io.Writer, privateKey *PrivateKey, opts *EncryptOptions, peerPublicKeys ...*PublicKey) (EncryptWriter, error) {
+	return newEncryptWriter(w, privateKey, opts, 0, peerPublicKeys...)
+}
+
+// newEncryptWriter returns the writer of an envelope, with flags set in
+// the header along with those of opts.
+func newEncryptWriter(w io.Writer, privateKey *PrivateKey, opts *EncryptOptions, flags byte, peerPublicKeys ...*PublicKey) (EncryptWriter, error) {
+	publicKey, recipients, err := senderRecipients(privateKey, opts, peerPublicKeys)
+	if err != nil {
+		return nil, err
+	}
+	return sealWriter(w, &publicKey, recipients, opts, flags)
+}
+
+// sealWriter returns the writer of an envelope from publicKey to the
+// recipients, which are only read so they can be shared between
+// envelopes.
+func sealWriter(w io.Writer, publicKey *PublicKey, recipients []Recipient, opts *EncryptOptions, flags byte) (EncryptWriter, error) {
+	if opts == nil {
+		opts = &EncryptOptions{}
+	}
+	var metadata []byte
+	if opts.Metadata != nil {
+		flags |= flagMetadata
+		var err error
+		if metadata, err = opts.Metadata.marshal(); err != nil {
+			return nil, err
+		}
+	}
+	header, nonce, aead, recipients, err := sealEnvelope(nil, publicKey, recipients, opts, flags)
+	if err != nil {
+		return nil, err
+	}
+	e := &encryptWriter{
+		w:        w,
+		aead:     aead,
+		nonce:    nonce,
+		ad:       associatedData(opts.AD),
+		padded:   opts.Pad,
+		chunkLen: chunkSize,
+		buf:      getChunkBuf(0),
+		chunks:   make([]chunk, pipelineChunks(opts.jobs())),
+	}
+	// one allocation for the nonces of the writer and each chunk
+	nonceSize := aead.NonceSize()
+	nonces := make([]byte, (len(e.chunks)+1)*nonceSize)
+	e.chunkNonce = nonces[:nonceSize:nonceSize]
+	for i := range e.chunks {
+		nonces = nonces[nonceSize:]
+		e.chunks[i].nonce = nonces[:nonceSize:nonceSize]
+		e.chunks[i].plaintext = getChunkBuf(0)
+		e.chunks[i].frame = getChunkBuf(0)
+	}
+
+	if opts.Pad {
+		e.chunkLen-- // for the pad marker
+	}
+	if opts.SigningKey != nil || opts.Authenticate {
+		e.transcript = newTranscript()
+	}
+	if opts.SigningKey != nil {
+		e.signingKey = opts.SigningKey
+		verifyKey := opts.SigningKey.VerifyKey()
+		header = e.seal(header, nonceVerifyKey, verifyKey[:])
+	}
+	if opts.Authenticate {
+		e.recipients = recipients
+		e.random = opts.random()
+	}
+
+	if err := e.write(header); err != nil {
+		return nil, err
+	}
+	if jobs := opts.jobs(); jobs > 1 {
+		e.pipe = newPipeline(len(e.chunks), jobs, e.sealChunk)
+		for i := range e.chunks {
+			e.pipe.free <- &e.chunks[i]
+		}
+		e.drained = make(chan error, 1)
+		go e.drain(e.pipe)
+	}
+	var wc EncryptWriter = e
+	if opts.Compress {
+		wc = newCompressWriter(e)
+	}
+	if metadata != nil {
+		if _, err := wc.Write(metadata); err != nil {
+			wc.Abort()
+			return nil, err
+		}
+	}
+	return wc, nil
+}
+
+func (e *encryptWriter) Write(p []byte) (n int, err error) {
+	if e.err != nil {
+		return 0, e.err
+	}
+	for len(p) > 0 {
+		// only flush a full chunk once more data arrives, as the last
+		// chunk has to be marked final
+		if len(e.buf) == e.chunkLen {
+			if err := e.flush(false, 0); err != nil {
+				e.release()
+				return n, err
+			}
+		}
+		l := copy(e.buf[len(e.buf):e.chunkLen], p)
+		e.buf = e.buf[:len(e.buf)+l]
+		p = p[l:]
+		n += l
+	}
+	e.n += int64(n)
+	return n, nil
+}
+
+// Close writes the final chunk, tags and signature, it does not close the
+// underlying writer.
+func (e *encryptWriter) Close() error {
+	if e.err != nil {
+		e.release()
+		return e.err
+	}
+	var padding int64
+	if e.padded {
+		padding = paddedLen(e.n) - e.n
+		for int64(len(e.buf))+padding > int64(e.chunkLen) {
+			l := e.chunkLen - len(e.buf)
+			if err := e.flush(false, l); err != nil {
+				e.release()
+				return err
+			}
+			padding -= int64(l)
+		}
+	}
+	if err := e.flush(true, int(padding)); err != nil {
+		e.release()
+		return err
+	}
+	if err := e.release(); err != nil {
+		e.err = err
+		return err
+	}
+	if e.transcript != nil {
+		if err := e.writeTrailer(e.transcript.Sum(nil)); err != nil {
+			e.err = err
+			return err
+		}
+	}
+	e.err = errClosed
+	return nil
+}
+
+// Abort stops the writer without writing the final chunk.
+func (e *encryptWriter) Abort() error {
+	err := e.release()
+	if e.err == nil {
+		e.err = errClosed
+	}
+	return err
+}
+
+// release stops the pipeline, if any, and returns the chunk buffers to the
+// pool. It returns the first error writing the frames.
+func (e *encryptWriter) release() error {
+	err := e.stop()
+	putChunkBuf(e.buf)
+	for i := range e.chunks {
+		putChunkBuf(e.chunks[i].plaintext)
+		putChunkBuf(e.chunks[i].frame)
+	}
+	e.buf, e.chunks = nil, nil
+	return err
+}
+
+// writeTrailer writes the tags and signature of the transcript digest.
+func (e *encryptWriter) writeTrailer(digest []byte) error {
+	var trailer []byte
+	for _, recipient := range e.recipients {
+		x, ok := recipient.(*x25519Recipient)
+		if !ok {
+			// only X25519 recipients share a key with the sender
+			tag := make([]byte, authTagLen)
+			if _, err := io.ReadFull(e.random, tag); err != nil {
+				return err
+			}
+			trailer = append(trailer, tag...)
+			continue
+		}
+		trailer = append(trailer, authTag(&x.shared, digest)...)
+	}
+	if e.signingKey != nil {
+		trailer = e.seal(trailer, nonceSignature, e.signingKey.sign(digest))
+	}
+	_, err := e.w.Write(trailer)
+	return err
+}
+
+// flush seals and writes the pending chunk, followed by the pad marker and
+// padding zeros of a padded envelope. With a pipeline the chunk is only
+// submitted, it is written once it and the chunks before it are sealed.
+func (e *encryptWriter) flush(final bool, padding int) error {
+	if e.index > maxChunkIndex {
+		e.err = ErrMessageTooLarge
+		return e.err
+	}
+	if e.padded {
+		e.buf = append(e.buf, padMarker)
+		for ; padding > 0; padding-- {
+			e.buf = append(e.buf, 0)
+		}
+	}
+	c := &e.chunks[0]
+	if e.pipe != nil {
+		if err := e.pipe.failed(); err != nil {
+			e.err = err
+			return err
+		}
+		c = <-e.pipe.free
+	}
+	c.index, c.final = e.index, final
+	c.plaintext, e.buf = e.buf, c.plaintext[:0]
+	e.index++
+
+	if e.pipe != nil {
+		e.pipe.submit(c)
+		return nil
+	}
+	e.sealChunk(c)
+	if err := e.write(c.frame); err != nil {
+		e.err = err
+		return err
+	}
+	return nil
+}
+
+// drain writes the frames of the pipeline in order, and returns their
+// chunks to it. It stops writing at the first error, which it sends on
+// e.drained once the pipeline is closed.
+func (e *encryptWriter) drain(p *pipeline) {
+	var err error
+	for c, ok := p.next(); ok; c, ok = p.next() {
+		if err == nil {
+			if err = e.write(c.frame); err != nil {
+				p.fail(err)
+			}
+		}
+		p.free <- c
+	}
+	e.drained <- err
+}
+
+// stop closes the pipeline, if any, and waits for every frame to be
+// written.
+func (e *encryptWriter) stop() error {
+	if e.pipe == nil {
+		return nil
+	}
+	e.pipe.close()
+	e.pipe = nil
+	return <-e.drained
+}
+
+// sealChunk frames and seals a chunk, it may run along with others.
+func (e *encryptWriter) sealChunk(c *chunk) {
+	prefix, kind := c.index, nonceChunk
+	if c.final {
+		prefix, kind = prefix|finalChunkFlag, nonceFinalChunk
+	}
+	c.frame = c.frame[:chunkPrefixLen]
+	binary.BigEndian.PutUint32(c.frame, prefix)
+
+	chunkNonce(c.nonce, e.nonce, c.index, kind)
+	c.frame = e.aead.Seal(c.frame, c.nonce, c.plaintext, e.ad)
+}
+
+// seal appends plaintext sealed under the session key to dst.
+func (e *encryptWriter) seal(dst []byte, kind byte, plaintext []byte) []byte {
+	chunkNonce(e.chunkNonce, e.nonce, 0, kind)
+	return e.aead.Seal(dst, e.chunkNonce, plaintext, e.ad)
+}
+
+// write writes p to the underlying writer and adds it to the transcript.
+func (e *encryptWriter) write(p []byte) error {
+	if e.transcript != nil {
+		e.transcript.Write(p)
+	}
+	_, err := e.w.Write(p)
+	return err
+}
+
+type decryptReader struct {
+	r     io.Reader
+	aead  cipher.AEAD
+	nonce []byte
+	ad    []byte // digest of the associated data
+
+	shared     *sharedKey // with an X25519 identity
+	slot       int        // opened by the identity
+	sender     *PublicKey // with flagAuthenticated
+	signer     *VerifyKey // with flagSigned
+	transcript hash.Hash
+	tagsLen    int
+	trailerLen int
+	trailer    []byte // tags and sealed signature
+
+	padded      bool
+	compressed  bool
+	hasMetadata bool
+	metadata    *Metadata // read by content
+	archive     bool
+
+	index      uint32 // of the next frame
+	final      bool   // the final frame is read
+	last       bool   // the final chunk is being read
+	chunkNonce []byte
+	jobs       int
+	chunks     []chunk   // opened in place, or by the pipeline
+	pipe       *pipeline // with more than one job, once started
+	cur        *chunk    // being read
+	buf        []byte    // plaintext not yet read
+	err        error
+}
+
+// NewDecryptReader returns a reader which decrypts the envelope read from r.
+// Each chunk is authenticated before any of its plaintext is returned, and
+// a stream which is cut short, reordered or lacks its final chunk fails
+// with ErrTruncated, ErrChunkOutOfOrder or ErrMissingFinalChunk.
+//
+// The signature of a signed envelope, and the tag of an authenticated
+// one, are verified before the final chunk is returned. The earlier chunks
+// are read before their sender or signer is known to be genuine.
+//
+// Envelopes from before version 2 are sealed in one piece and are read
+// into memory to be decrypted.
+//
+// Close releases a reader which is not read to the end or to an error, it
+// does not close r.
+func NewDecryptReader(r io.Reader, privateKey *PrivateKey) (io.ReadCloser, error) {
+	return NewDecryptReaderWithOptions(r, privateKey, nil)
+}
+
+// NewDecryptReaderWithOptions is like NewDecryptReader, with the
+// requirements in opts.
+func NewDecryptReaderWithOptions(r io.Reader, privateKey *PrivateKey, opts *DecryptOptions) (io.ReadCloser, error) {
+	return NewDecryptReaderWithIdentity(r, privateKey, opts)
+}
+
+// NewDecryptReaderWithIdentity is like NewDecryptReaderWithOptions, with
+// the session key unwrapped by identity. Only a *PrivateKey can verify
+// the sender of an authenticated envelope, and open envelopes from before
+// version 4.
+func NewDecryptReaderWithIdentity(r io.Reader, identity Identity, opts *DecryptOptions) (io.ReadCloser, error) {
+	dr, _, err := newReader(r, identity, opts)
+	return dr, err
+}
+
+// NewDecryptReaderWithMetadata is like NewDecryptReaderWithOptions, and
+// also returns the metadata of the message, nil if it has none.
+func NewDecryptReaderWithMetadata(r io.Reader, privateKey *PrivateKey, opts *DecryptOptions) (io.ReadCloser, *Metadata, error) {
+	content, d, err := newReader(r, privateKey, opts)
+	if err != nil || d == nil {
+		return content, nil, err
+	}
+	return content, d.metadata, nil
+}
+
+// readCloser reads the message of a decryptReader, and closes it.
+type readCloser struct {
+	io.Reader
+	io.Closer
+}
+
+// newReader returns the reader of the message in the envelope read from r,
+// and the decryptReader of chunked envelopes.
+func newReader(r io.Reader, identity Identity, opts *DecryptOptions) (io.ReadCloser, *decryptReader, error) {
+	br := bufio.NewReader(r)
+	h, err := readHeader(br)
+	if err != nil {
+		return nil, nil, err
+	}
+	if h.version < version2 {
+		if err := opts.check(h); err != nil {
+			return nil, nil, err
+		}
+		privateKey, ok := identity.(*PrivateKey)
+		if !ok {
+			return nil, nil, ErrFailedToDecrypt
+		}
+		message, err := ioutil.ReadAll(br)
+		if err != nil {
+			return nil, nil, err
+		}
+		out, err := h.open(nil, message, privateKey)
+		if err != nil {
+			return nil, nil, err
+		}
+		return ioutil.NopCloser(bytes.NewReader(out)), nil, nil
+	}
+	d, err := newDecryptReader(h, br, identity, opts)
+	if err != nil {
+		return nil, nil, err
+	}
+	content, err := d.content()
+	if err != nil {
+		d.release()
+		return nil, nil, err
+	}
+	return readCloser{content, d}, d, nil
+}
+
+func newDecryptReader(h *header, r io.Reader, identity Identity, opts *DecryptOptions) (*decryptReader, error) {
+	if err := opts.check(h); err != nil {
+		return nil, err
+	}
+
+	d := &decryptReader{
+		r:     r,
+		nonce: h.nonce,
+	}
+	if opts != nil {
+		d.ad = associatedData(opts.AD)
+	}
+	if h.flags&(flagSigned|flagAuthenticated) != 0 {
+		d.transcript = newTranscript()
+		d.transcript.Write(h.raw)
+	}
+	if h.flags&flagAuthenticated != 0 {
+		d.tagsLen = len(h.slots) * authTagLen
+		d.trailerLen += d.tagsLen
+	}
+	if h.flags&flagSigned != 0 {
+		d.trailerLen += sealedSignatureLen
+	}
+	d.padded = h.flags&flagPadded != 0
+	d.compressed = h.flags&flagCompressed != 0
+	d.hasMetadata = h.flags&flagMetadata != 0
+	d.archive = h.flags&flagArchive != 0
+	d.jobs = opts.jobs()
+	d.chunks = make([]chunk, pipelineChunks(d.jobs))
+	for i := range d.chunks {
+		d.chunks[i].frame = getChunkBuf(chunkSize + tagLen + d.trailerLen + 1)
+		d.chunks[i].plaintext = getChunkBuf(0)
+	}
+
+	// compute the shared key once for all of the slots
+	if k, ok := identity.(*PrivateKey); ok {
+		identity = &x25519Identity{k.sharedKey(&h.sender)}
+	}
+	if x, ok := identity.(*x25519Identity); ok {
+		d.shared = &x.shared
+	} else if h.flags&flagAuthenticated != 0 && opts != nil && opts.Sender != nil {
+		return nil, ErrNotAuthenticated
+	}
+
+	if h.version >= version3 {
+		// the slots find the session key without the payload
+		sessionKey, r, err := h.unwrap(identity)
+		if err != nil {
+			return nil, err
+		}
+		if d.aead, err = newAEAD(h.suite, sessionKey); err != nil {
+			return nil, err
+		}
+		d.slot = r
+		// one allocation for the nonces of the reader and each chunk
+		nonceSize := d.aead.NonceSize()
+		nonces := make([]byte, (len(d.chunks)+1)*nonceSize)
+		d.chunkNonce = nonces[:nonceSize:nonceSize]
+		for i := range d.chunks {
+			nonces = nonces[nonceSize:]
+			d.chunks[i].nonce = nonces[:nonceSize:nonceSize]
+		}
+		c := &d.chunks[0]
+		if err := d.readFrame(c); err != nil {
+			return nil, err
+		}
+		if err := d.open(d.aead, c); err != nil {
+			return nil, err
+		}
+	} else if err := d.trySlots(h); err != nil {
+		return nil, err
+	}
+
+	if h.flags&flagAuthenticated != 0 && d.shared != nil {
+		d.sender = &h.sender
+	}
+	if h.flags&flagSigned != 0 {
+		key, err := d.unseal(nil, nonceVerifyKey, h.sealedSigner)
+		if err != nil {
+			return nil, err
+		}
+		var signer VerifyKey
+		copy(signer[:], key)
+		if opts != nil && opts.Signer != nil && *opts.Signer != signer {
+			return nil, ErrUnexpectedSigner
+		}
+		d.signer = &signer
+	}
+	d.cur, d.last = &d.chunks[0], d.final
+	if err := d.verify(); err != nil {
+		return nil, err
+	}
+	d.buf = d.cur.content
+	return d, nil
+}
+
+func (d *decryptReader) Read(p []byte) (n int, err error) {
+	for len(d.buf) == 0 {
+		if d.err != nil {
+			return 0, d.err
+		}
+		if d.last {
+			d.err = io.EOF
+		} else {
+			d.err = d.next()
+		}
+		if d.err != nil {
+			d.release()
+		}
+	}
+	n = copy(p, d.buf)
+	d.buf = d.buf[n:]
+	return n, nil
+}
+
+// Close stops the reader, the message can't be read after.
+func (d *decryptReader) Close() error {
+	d.release()
+	if d.err == nil {
+		d.err = errClosedReader
+	}
+	return nil
+}
+
+// next moves on to the next chunk. The final chunk is only read once the
+// envelope is verified.
+func (d *decryptReader) next() error {
+	c := d.cur
+	if d.jobs > 1 {
+		if d.pipe == nil {
+			d.pipe = newPipeline(len(d.chunks), d.jobs, func(c *chunk) {
+				c.err = d.open(d.aead, c)
+			})
+			for i := range d.chunks {
+				if &d.chunks[i] != d.cur {
+					d.pipe.free <- &d.chunks[i]
+				}
+			}
+			go d.readAhead(d.pipe)
+		}
+		d.pipe.free <- d.cur
+		var ok bool
+		if c, ok = d.pipe.next(); !ok {
+			return ErrMissingFinalChunk
+		}
+		if c.err != nil {
+			return c.err
+		}
+	} else if err := d.readFrame(c); err != nil {
+		return err
+	} else if err := d.open(d.aead, c); err != nil {
+		return err
+	}
+
+	if c.final {
+		d.last = true
+		if err := d.verify(); err != nil {
+			return err
+		}
+	}
+	d.cur, d.buf = c, c.content
+	return nil
+}
+
+// readAhead reads the frames in order and submits them to the pipeline,
+// until the final frame, an error or the reader stops.
+func (d *decryptReader) readAhead(p *pipeline) {
+	defer p.close()
+	for {
+		var c *chunk
+		select {
+		case c = <-p.free:
+		case <-p.quit:
+			return
+		}
+		err := d.readFrame(c)
+		c.err = err
+		final := c.final
+		p.submit(c)
+		if err != nil || final {
+			return
+		}
+	}
+}
+
+// release stops the pipeline, if any, and returns the chunk buffers to the
+// pool once the payload is read or fails.
+func (d *decryptReader) release() {
+	if d.pipe != nil {
+		close(d.pipe.quit)
+		for _, ok := d.pipe.next(); ok; _, ok = d.pipe.next() {
+		}
+		d.pipe = nil
+	}
+	for i := range d.chunks {
+		putChunkBuf(d.chunks[i].frame)
+		putChunkBuf(d.chunks[i].plaintext)
+	}
+	d.chunks, d.cur, d.buf, d.trailer = nil, nil, nil, nil
+}
+
+// readFrame reads the next frame into c.
+func (d *decryptReader) readFrame(c *chunk) error {
+	var prefix [chunkPrefixLen]byte
+	if _, err := io.ReadFull(d.r, prefix[:]); err == io.EOF {
+		return ErrMissingFinalChunk
+	} else if err != nil {
+		return truncated(err)
+	}
+	index := binary.BigEndian.Uint32(prefix[:])
+	d.final = index&finalChunkFlag != 0
+	if index&maxChunkIndex != d.index {
+		return ErrChunkOutOfOrder
+	}
+	c.index, c.final = d.index, d.final
+	d.index++
+
+	if !d.final {
+		if _, err := io.ReadFull(d.r, c.frame[:chunkSize+tagLen]); err != nil {
+			return truncated(err)
+		}
+		c.sealed = c.frame[:chunkSize+tagLen]
+		d.hash(prefix[:], c.sealed)
+		return nil
+	}
+
+	// the final chunk may be short, read one byte more than a full chunk
+	// and signature to make sure nothing follows them
+	n, err := io.ReadFull(d.r, c.frame)
+	switch {
+	case err == nil:
+		return ErrTrailingData
+	case err != io.EOF && err != io.ErrUnexpectedEOF:
+		return err
+	case n < tagLen+d.trailerLen:
+		return ErrTruncated
+	}
+	c.sealed = c.frame[:n-d.trailerLen]
+	d.trailer = c.frame[n-d.trailerLen : n]
+	d.hash(prefix[:], c.sealed)
+	return nil
+}
+
+// open authenticates and decrypts the sealed chunk, it may run along with
+// others.
+func (d *decryptReader) open(aead cipher.AEAD, c *chunk) (err error) {
+	kind := nonceChunk
+	if c.final {
+		kind = nonceFinalChunk
+	}
+	if len(c.nonce) != aead.NonceSize() {
+		c.nonce = make([]byte, aead.NonceSize())
+	}
+	chunkNonce(c.nonce, d.nonce, c.index, kind)
+	c.plaintext, err = aead.Open(c.plaintext[:0], c.nonce, c.sealed, d.ad)
+	if err != nil {
+		return ErrFailedToDecrypt
+	}
+	c.content = c.plaintext
+	if d.padded {
+		c.content, err = unpad(c.plaintext)
+	}
+	return err
+}
+
+// unseal appends the plaintext of a value sealed under the session key to
+// dst.
+func (d *decryptReader) unseal(dst []byte, kind byte, sealed []byte) ([]byte, error) {
+	chunkNonce(d.chunkNonce, d.nonce, 0, kind)
+	out, err := d.aead.Open(dst, d.chunkNonce, sealed, d.ad)
+	if err != nil {
+		return nil, ErrFailedToDecrypt
+	}
+	return out, nil
+}
+
+// verify checks the tag and signature once the final chunk has been opened.
+func (d *decryptReader) verify() error {
+	if !d.final || d.transcript == nil {
+		return nil
+	}
+	digest := d.transcript.Sum(nil)
+	if d.sender != nil {
+		tag := d.trailer[d.slot*authTagLen : (d.slot+1)*authTagLen]
+		if !verifyAuthTag(d.shared, digest, tag) {
+			return ErrBadAuthenticator
+		}
+	}
+	if d.signer != nil {
+		signature, err := d.unseal(nil, nonceSignature, d.trailer[d.tagsLen:])
+		if err != nil || !d.signer.verify(digest, signature) {
+			return ErrBadSignature
+		}
+	}
+	return nil
+}
+
+// hash adds a frame to the transcript.
+func (d *decryptReader) hash(prefix, sealed []byte) {
+	if d.transcript != nil {
+		d.transcript.Write(prefix)
+		d.transcript.Write(sealed)
+	}
+}
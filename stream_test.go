@@ -0,0 +1,277 @@
+package alex
+
+import (
+	"bytes"
+	"crypto/rand"
+	"io"
+	"io/ioutil"
+	"runtime"
+	"testing"
+	"time"
+)
+
+func TestEncryptWriter(t *testing.T) {
+	sender, _ := generateKeys(t)
+	recipient, recipientPublicKey := generateKeys(t)
+
+	for _, n := range []int{0, 1, chunkSize - 1, chunkSize, chunkSize + 1, 3*chunkSize + 17} {
+		msg := make([]byte, n)
+		if _, err := io.ReadFull(rand.Reader, msg); err != nil {
+			t.Fatal(err)
+		}
+
+		var enc bytes.Buffer
+		w, err := NewEncryptWriter(&enc, sender, recipientPublicKey)
+		if err != nil {
+			t.Fatal(err)
+		}
+		// write in uneven pieces to exercise chunk boundaries
+		for p := msg; len(p) > 0; {
+			l := len(p)
+			if l > 1000 {
+				l = 1000
+			}
+			if _, err := w.Write(p[:l]); err != nil {
+				t.Fatal(err)
+			}
+			p = p[l:]
+		}
+		if err := w.Close(); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := w.Write([]byte{0}); err != errClosed {
+			t.Errorf("Expected %s after close but got %v", errClosed, err)
+		}
+
+		// a single recipient count takes one byte
+		if l := headerLen(version5, suiteX25519AES256GCM, 1) - (maxRecipientCountLen16 - 1) + payloadLen(n); enc.Len() != l {
+			t.Errorf("%d: Expected envelope length %d but got %d", n, l, enc.Len())
+		}
+
+		dec, err := Decrypt(enc.Bytes(), recipient)
+		if err != nil {
+			t.Fatalf("%d: Unexpected decrypt error: %s", n, err)
+		}
+		if !bytes.Equal(dec, msg) {
+			t.Errorf("%d: Decrypted message not equal", n)
+		}
+	}
+}
+
+func TestDecryptReader(t *testing.T) {
+	sender, _ := generateKeys(t)
+	recipient, recipientPublicKey := generateKeys(t)
+
+	msg := make([]byte, 3*chunkSize+17)
+	if _, err := io.ReadFull(rand.Reader, msg); err != nil {
+		t.Fatal(err)
+	}
+	enc, err := Encrypt(msg, sender, recipientPublicKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	r, err := NewDecryptReader(bytes.NewReader(enc), recipient)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// read in small pieces to exercise chunk boundaries
+	var dec bytes.Buffer
+	buf := make([]byte, 1000)
+	if _, err := io.CopyBuffer(&dec, r, buf); err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(dec.Bytes(), msg) {
+		t.Error("Decrypted message not equal")
+	}
+}
+
+func TestDecryptReaderErrors(t *testing.T) {
+	sender, _ := generateKeys(t)
+	recipient, recipientPublicKey := generateKeys(t)
+
+	msg := make([]byte, 3*chunkSize+17)
+	enc, err := Encrypt(msg, sender, recipientPublicKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	header := headerLen(version5, suiteX25519AES256GCM, 1) - (maxRecipientCountLen16 - 1)
+	frame := chunkPrefixLen + chunkSize + tagLen
+	chunk := func(i int) []byte {
+		return enc[header+i*frame : header+(i+1)*frame]
+	}
+	join := func(parts ...[]byte) []byte {
+		return bytes.Join(parts, nil)
+	}
+	tampered := join(enc)
+	tampered[header+frame+100] ^= 1
+
+	// the final chunk is found by reading to the end, trailing data is
+	// only detected once it exceeds a full chunk
+	full, err := Encrypt(make([]byte, 2*chunkSize), sender, recipientPublicKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, tc := range []struct {
+		name string
+		data []byte
+		err  error
+	}{
+		{"truncated header", enc[:header-1], ErrTruncated},
+		{"truncated chunk", enc[:header+frame+100], ErrTruncated},
+		{"missing final chunk", enc[:header+3*frame], ErrMissingFinalChunk},
+		{"reordered", join(enc[:header], chunk(0), chunk(2), chunk(1), enc[header+3*frame:]), ErrChunkOutOfOrder},
+		{"trailing data after short chunk", join(enc, []byte{0}), ErrFailedToDecrypt},
+		{"trailing data", join(full, []byte{0}), ErrTrailingData},
+		{"tampered", tampered, ErrFailedToDecrypt},
+	} {
+		for _, jobs := range []int{1, 4} {
+			r, err := NewDecryptReaderWithOptions(bytes.NewReader(tc.data), recipient, &DecryptOptions{Jobs: jobs})
+			if err == nil {
+				_, err = io.Copy(ioutil.Discard, r)
+			}
+			if err != tc.err {
+				t.Errorf("%s, %d jobs: Expected %s but got %v", tc.name, jobs, tc.err, err)
+			}
+		}
+	}
+}
+
+// failingWriter fails once more than n bytes are written to it.
+type failingWriter struct {
+	n int
+}
+
+func (w *failingWriter) Write(p []byte) (int, error) {
+	if w.n -= len(p); w.n < 0 {
+		return 0, io.ErrShortWrite
+	}
+	return len(p), nil
+}
+
+func TestParallelJobsWriteError(t *testing.T) {
+	sender, _ := generateKeys(t)
+	_, recipientPublicKey := generateKeys(t)
+
+	w, err := NewEncryptWriterWithOptions(&failingWriter{n: 2 * chunkSize}, sender, &EncryptOptions{Jobs: 4}, recipientPublicKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	msg := make([]byte, chunkSize)
+	for i := 0; i < 100 && err == nil; i++ {
+		_, err = w.Write(msg)
+	}
+	if cerr := w.Close(); cerr != io.ErrShortWrite || (err != nil && err != io.ErrShortWrite) {
+		t.Errorf("Expected %s but got %v, %v", io.ErrShortWrite, err, cerr)
+	}
+}
+
+// goroutinesBack waits for the number of goroutines to go back to n, and
+// returns whether it did.
+func goroutinesBack(n int) bool {
+	for i := 0; i < 100; i++ {
+		if runtime.NumGoroutine() <= n {
+			return true
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	return false
+}
+
+func TestParallelJobsRelease(t *testing.T) {
+	sender, _ := generateKeys(t)
+	recipient, recipientPublicKey := generateKeys(t)
+	// longer than the chunks of the pipeline
+	msg := make([]byte, 20*chunkSize)
+	enc, err := Encrypt(msg, sender, recipientPublicKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	opts := &EncryptOptions{Jobs: 4}
+	n := runtime.NumGoroutine()
+
+	// readers closed before the end
+	for i := 0; i < 10; i++ {
+		r, err := NewDecryptReaderWithOptions(bytes.NewReader(enc), recipient, &DecryptOptions{Jobs: 4})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := io.ReadFull(r, make([]byte, 2*chunkSize)); err != nil {
+			t.Fatal(err)
+		}
+		r.Close()
+		if _, err := r.Read(make([]byte, 1)); err != errClosedReader {
+			t.Errorf("Expected %s after close but got %v", errClosedReader, err)
+		}
+	}
+	// writers which fail without Close
+	for i := 0; i < 10; i++ {
+		w, err := NewEncryptWriterWithOptions(&failingWriter{n: 2 * chunkSize}, sender, opts, recipientPublicKey)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for err == nil {
+			_, err = w.Write(msg)
+		}
+	}
+	// writers aborted before the end
+	var aborted bytes.Buffer
+	for i := 0; i < 10; i++ {
+		aborted.Reset()
+		w, err := NewEncryptWriterWithOptions(&aborted, sender, opts, recipientPublicKey)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := w.Write(msg); err != nil {
+			t.Fatal(err)
+		}
+		if err := w.Abort(); err != nil {
+			t.Errorf("Unexpected abort error: %s", err)
+		}
+	}
+	if !goroutinesBack(n) {
+		t.Errorf("Expected %d goroutines but got %d", n, runtime.NumGoroutine())
+	}
+
+	if _, err := Decrypt(aborted.Bytes(), recipient); err != ErrMissingFinalChunk {
+		t.Errorf("Expected %s but got %v", ErrMissingFinalChunk, err)
+	}
+}
+
+func TestParallelJobs(t *testing.T) {
+	sender, _ := generateKeys(t)
+	recipient, recipientPublicKey := generateKeys(t)
+	signingKey, _ := GenerateSigningKey(rand.Reader)
+	verifyKey := signingKey.VerifyKey()
+
+	for _, n := range []int{0, chunkSize, 9*chunkSize + 3} {
+		msg := make([]byte, n)
+		if _, err := io.ReadFull(rand.Reader, msg); err != nil {
+			t.Fatal(err)
+		}
+
+		var envelopes [][]byte
+		for _, jobs := range []int{1, 3, 8} {
+			opts := &EncryptOptions{SigningKey: &signingKey, Pad: true, Jobs: jobs, Rand: testRand(1)}
+			enc, err := EncryptWithOptions(msg, sender, opts, recipientPublicKey)
+			if err != nil {
+				t.Fatal(err)
+			}
+			envelopes = append(envelopes, enc)
+
+			dec, err := DecryptWithOptions(enc, recipient, &DecryptOptions{Signer: &verifyKey, Jobs: jobs})
+			if err != nil {
+				t.Fatalf("%d, %d jobs: Unexpected decrypt error: %s", n, jobs, err)
+			}
+			if !bytes.Equal(dec, msg) {
+				t.Errorf("%d, %d jobs: Decrypted message not equal", n, jobs)
+			}
+		}
+		for _, enc := range envelopes[1:] {
+			if !bytes.Equal(enc, envelopes[0]) {
+				t.Errorf("%d: Expected the same envelope for any number of jobs", n)
+			}
+		}
+	}
+}